@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"         // For telling a normal server close from a failure
+	"log/slog"       // For structured logging
+	"net/http"       // For the admin server
+	"net/http/pprof" // For the profiling handlers
+
+	"github.com/prometheus/client_golang/prometheus/promhttp" // Serves Prometheus metrics over HTTP
+)
+
+// newAdminServer returns the server for -admin-addr. It carries everything
+// that is for operators and their tools rather than for the frontend:
+//   - "/metrics" for Prometheus, see metrics.go
+//   - "/stats", a small JSON summary, see stats.go
+//   - "/healthz" and "/readyz" for the orchestrator, see health.go
+//   - "/version", the commit and Go version of the build, see version.go
+//   - "/notify" to message one client, see notify.go
+//   - "/ingest", "/ingest/pause" and "/ingest/resume" to hold back the stream, see ingest.go
+//   - "/ws/raw", a WebSocket with the UDP packets as received, see tap.go
+//   - "/debug/pprof/", e.g. `go tool pprof http://localhost:6060/debug/pprof/goroutine`
+//
+// It is kept apart from the public server, so none of this is ever reachable
+// through "/ws"'s port. It only runs when asked for: pprof and the stats give
+// away more than a gateway should by default. Locally -admin-addr
+// localhost:6060 keeps it on this machine. In a container it has to listen on
+// all interfaces (e.g. -admin-addr :6060) for probes and scrapers to reach it,
+// but its port should not be published.
+// With perClient, "/stats" also lists every connected client. Pages on one of
+// the origins may fetch "/stats" from another origin, see cors.go. "/notify",
+// "/ingest/pause", "/ingest/resume" and "/ws/raw" need one of the `tokens` and
+// refuse other origins, see requireOperator. Clients of "/ws/raw" are served
+// by `tap` like "/ws" ones, with `raw`.
+func newAdminServer(addr string, hub, tap *Hub, raw EndpointOptions, perClient bool, origins originSet, tokens []authToken) *http.Server {
+	// A mux of its own: importing net/http/pprof also registers its handlers on
+	// http.DefaultServeMux, so we must not rely on that.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/stats", withCORS(origins, handleStats(hub, perClient)))
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/notify", requireOperator(tokens, origins, handleNotify(hub)))
+	mux.HandleFunc("/ingest", handleIngest(hub))
+	mux.Handle("/ingest/pause", requireOperator(tokens, origins, handleIngestSwitch(hub, true)))
+	mux.Handle("/ingest/resume", requireOperator(tokens, origins, handleIngestSwitch(hub, false)))
+	mux.Handle("/ws/raw", requireOperator(tokens, origins, handleConnections(tap, raw)))
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// serveAdmin runs the admin server until it is shut down.
+func serveAdmin(server *http.Server) {
+	slog.Info("admin server listening", "admin_addr", server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fatal("admin server failed", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"       // For describing bad entries
+	"log/slog"  // For logging blocked senders
+	"net"       // For the sender's address
+	"net/netip" // For parsing and matching IPs and CIDR ranges
+	"strings"   // For splitting the flag value
+	"sync"      // For the set of logged senders
+)
+
+// --- UDP Sender Allowlist ---
+// Anyone who can reach the UDP port can inject robot states. With -udp-allow
+// only packets from the listed simulation hosts are accepted, e.g.
+// "10.0.0.5,10.0.1.0/24,fd00::/8". Packets from everywhere else are dropped
+// (and counted) right after reading them. Packets over a Unix datagram socket
+// are always accepted, who may send to it is up to the socket file's permissions.
+// An empty list accepts every sender.
+
+// maxLoggedSenders bounds how many blocked senders are remembered for logging,
+// so spoofed floods can't grow the set forever.
+const maxLoggedSenders = 1000
+
+// senderAllowlist is the parsed -udp-allow. It is safe for concurrent use,
+// all listeners share one.
+type senderAllowlist struct {
+	prefixes []netip.Prefix
+
+	// logged are the blocked senders that have been logged already, each one
+	// is logged once instead of once per packet.
+	mutex  sync.Mutex
+	logged map[netip.Addr]bool
+}
+
+// parseSenderAllowlist parses a comma-separated list of IPs and CIDR ranges.
+// It returns nil for an empty list, which allows everyone.
+func parseSenderAllowlist(list string) (*senderAllowlist, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			// SYNTAX: Masked drops the host bits, "10.0.1.7/24" becomes "10.0.1.0/24".
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP nor a CIDR range", entry)
+		}
+		// A single address is a range of one.
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	return &senderAllowlist{prefixes: prefixes, logged: make(map[netip.Addr]bool)}, nil
+}
+
+// allow reports whether a packet from `from` may pass. A nil list allows everything.
+// Blocked packets are counted, and every blocked sender is logged once.
+func (l *senderAllowlist) allow(from net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	udp, ok := from.(*net.UDPAddr)
+	if !ok {
+		// A Unix socket sender, see above.
+		return true
+	}
+	// Dual-stack sockets report IPv4 senders as ::ffff:a.b.c.d, Unmap turns them back into IPv4.
+	addr := udp.AddrPort().Addr().Unmap()
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	udpPacketsBlocked.Inc()
+	l.mutex.Lock()
+	first := !l.logged[addr] && len(l.logged) < maxLoggedSenders
+	if first {
+		l.logged[addr] = true
+	}
+	l.mutex.Unlock()
+	if first {
+		slog.Warn("dropping UDP packets from a sender not in -udp-allow", "source", addr.String())
+	}
+	return false
+}
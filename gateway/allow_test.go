@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSenderAllowlist(t *testing.T) {
+	list, err := parseSenderAllowlist("10.0.0.5, 10.0.1.7/24,fd00::/8,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from net.Addr
+		want bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.6"), Port: 40000}, false},
+		// The host bits of "10.0.1.7/24" don't matter, the whole range is allowed.
+		{&net.UDPAddr{IP: net.ParseIP("10.0.1.0")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.1.255")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.2.1")}, false},
+		// An IPv4 sender on a dual-stack socket.
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.5")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, false},
+		{&net.UDPAddr{IP: net.ParseIP("fd12:3456::1")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1")}, false},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::2")}, false},
+		// Unix socket senders are up to the socket file's permissions.
+		{&net.UnixAddr{Name: "/tmp/sim.sock", Net: "unixgram"}, true},
+	}
+	for _, tt := range tests {
+		if got := list.allow(tt.from); got != tt.want {
+			t.Errorf("allow(%v) = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestParseSenderAllowlist(t *testing.T) {
+	for _, list := range []string{"", " , "} {
+		if l, err := parseSenderAllowlist(list); err != nil || l != nil {
+			t.Errorf("parseSenderAllowlist(%q) = %v, %v, want nil (allow all)", list, l, err)
+		}
+	}
+	// A nil list allows everyone.
+	var all *senderAllowlist
+	if !all.allow(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("nil allowlist blocked a sender")
+	}
+	for _, list := range []string{"10.0.0", "10.0.0.0/33", "robots.example", "10.0.0.5,nope"} {
+		if _, err := parseSenderAllowlist(list); err == nil {
+			t.Errorf("parseSenderAllowlist(%q) accepted an invalid entry", list)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"       // For passing the identity on to the handler
+	"crypto/sha256" // For hashing tokens to a fixed length before comparing
+	"crypto/subtle" // For constant-time comparison
+	"fmt"           // For describing invalid token lists
+	"log/slog"      // For logging rejected requests
+	"net/http"      // For the middleware
+	"strings"       // For parsing the Authorization header and the token list
+
+	"github.com/gorilla/websocket"
+)
+
+// authToken is one token -auth-token accepts and the identity it stands for.
+type authToken struct {
+	identity string
+	// Comparing SHA-256 digests keeps the comparison constant-time even when the
+	// lengths differ, subtle.ConstantTimeCompare alone returns early on a length mismatch.
+	digest [sha256.Size]byte
+}
+
+// parseAuthTokens parses -auth-token: a single token, or several comma-separated
+// ones for several operators. "alice:s3cret" names a token's identity (see
+// -single-session), an unnamed token is identified by its position, e.g.
+// "token-2". An empty spec disables authentication and returns nil.
+func parseAuthTokens(spec string) ([]authToken, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var tokens []authToken
+	seen := make(map[string]bool)
+	for i, entry := range strings.Split(spec, ",") {
+		identity, token, named := strings.Cut(entry, ":")
+		if !named {
+			identity, token = fmt.Sprintf("token-%d", i+1), entry
+		}
+		if token == "" || identity == "" {
+			return nil, fmt.Errorf("entry %d has no token or no name", i+1)
+		}
+		if seen[identity] {
+			return nil, fmt.Errorf("%q is named twice", identity)
+		}
+		seen[identity] = true
+		tokens = append(tokens, authToken{identity: identity, digest: sha256.Sum256([]byte(token))})
+	}
+	return tokens, nil
+}
+
+// identityKey is the context key requireToken stores the identity under.
+type identityKey struct{}
+
+// requestIdentity returns the identity requireToken found for r, "" without authentication.
+func requestIdentity(r *http.Request) string {
+	// SYNTAX: the ", _" form of a type assertion returns "" instead of panicking if the value is missing.
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+// requireToken wraps a handler so it only runs for requests carrying one of
+// the `tokens`, either as a `token` query parameter (browsers can't set headers on a WebSocket)
+// or as an `Authorization: Bearer <token>` header. Other requests get 401, or close
+// code 1008 if they are WebSocket handshakes (see reject). The handler finds the
+// token's identity with requestIdentity.
+// No tokens disable the check.
+func requireToken(tokens []authToken, next http.Handler) http.Handler {
+	if len(tokens) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := matchToken(tokens, requestToken(r))
+		if identity == "" {
+			slog.Warn("client rejected, bad token", "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+			reject(w, r, http.StatusUnauthorized, websocket.ClosePolicyViolation, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// matchToken returns the identity of the token among `tokens` that equals
+// presented, "" if none does.
+func matchToken(tokens []authToken, presented string) string {
+	got := sha256.Sum256([]byte(presented))
+	// Every token is compared, so the time taken doesn't tell which one matched.
+	identity := ""
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(got[:], token.digest[:]) == 1 {
+			identity = token.identity
+		}
+	}
+	return identity
+}
+
+// requestToken returns the token a request presents, "" if it has none.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	// SYNTAX: CutPrefix returns the rest of the string and whether the prefix was there.
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
+
+// requireOperator guards the admin endpoints that act on the gateway or show
+// what nothing else does, like "/notify", "/ingest/pause" and "/ws/raw". The admin server is meant for the
+// operator's own machine, but so is the operator's browser: any page it opens
+// could fire a cross-site POST at localhost:6060, and a plain form POST doesn't
+// even need a CORS preflight. So a request with an Origin header is refused
+// with 403 unless -allowed-origins names that origin (the default "*"
+// doesn't count), which leaves curl and scripts alone: they send none.
+// With -auth-token set it also needs a token, like "/ws" (see requireToken).
+func requireOperator(tokens []authToken, origins originSet, next http.Handler) http.Handler {
+	next = requireToken(tokens, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !origins.listed(r) {
+			slog.Warn("admin request rejected, foreign origin", "path", r.URL.Path, "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+			reject(w, r, http.StatusForbidden, websocket.ClosePolicyViolation, "origin not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireOperator(t *testing.T) {
+	tokens, err := parseAuthTokens("alice:s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		tokens  []authToken
+		origins string
+		origin  string
+		bearer  string
+		want    int
+	}{
+		{name: "curl", origins: "*", want: http.StatusOK},
+		{name: "any page with the * default", origins: "*", origin: "https://evil.example", want: http.StatusForbidden},
+		{name: "unlisted page", origins: "http://localhost:5173", origin: "https://evil.example", want: http.StatusForbidden},
+		{name: "listed page", origins: "http://localhost:5173", origin: "http://localhost:5173", want: http.StatusOK},
+		{name: "curl without token", tokens: tokens, origins: "*", want: http.StatusUnauthorized},
+		{name: "curl with wrong token", tokens: tokens, origins: "*", bearer: "guess", want: http.StatusUnauthorized},
+		{name: "curl with token", tokens: tokens, origins: "*", bearer: "s3cret", want: http.StatusOK},
+		{name: "unlisted page with token", tokens: tokens, origins: "*", origin: "https://evil.example", bearer: "s3cret", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(http.MethodPost, "/notify?client=1", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			requireOperator(tt.tokens, parseOrigins(tt.origins), ok).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls" // For loading the certificate
+	"errors"     // For describing a file in the way
+	"flag"       // For listing the settings
+	"fmt"        // For the report
+	"io"         // For the report's destination
+	"net"        // For trying the addresses
+	"os"         // For checking socket files
+)
+
+// --- Configuration Check ---
+// `-check` validates the configuration without serving anything, e.g. in CI or
+// right before a deploy: the flags and GATEWAY_* variables are parsed and
+// validated like for a real start, then every address the gateway would listen
+// on is bound once and released again. The resolved configuration is printed,
+// and the exit code says whether the gateway would have started (0) or not (1).
+// A real start can still fail if someone takes a port in between.
+
+// secretFlags are printed masked, the report may end up in CI logs.
+var secretFlags = map[string]bool{"auth-token": true}
+
+// runCheck prints the resolved configuration and the result of trying every
+// address to w. It returns the process exit code.
+func runCheck(w io.Writer, cfg *Config, udpAddrs []ingestAddr) int {
+	fmt.Fprintln(w, "configuration:")
+	printConfig(w, cfg)
+
+	fmt.Fprintln(w, "checks:")
+	failed := 0
+	report := func(what string, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "  FAIL %s: %v\n", what, err)
+			return
+		}
+		fmt.Fprintf(w, "  ok   %s\n", what)
+	}
+
+	for _, addr := range udpAddrs {
+		report("-udp-addr "+addr.String(), checkIngestAddr(cfg.UDPNetwork, addr))
+	}
+	report("-ws-addr "+cfg.WSAddr, checkTCPAddr(cfg.WSAddr))
+	if cfg.TCPAddr != "" {
+		report("-tcp-addr "+cfg.TCPAddr, checkTCPAddr(cfg.TCPAddr))
+	}
+	if cfg.AdminAddr != "" {
+		report("-admin-addr "+cfg.AdminAddr, checkTCPAddr(cfg.AdminAddr))
+	}
+	if cfg.TLSCert != "" {
+		_, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		report("-tls-cert "+cfg.TLSCert+" -tls-key "+cfg.TLSKey, err)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Fprintln(w, "all checks passed")
+	return 0
+}
+
+// printConfig lists every setting as its flag, marking the ones that aren't the default.
+func printConfig(w io.Writer, cfg *Config) {
+	// Registering the flags on a copy resets it to the defaults, so the copy is
+	// overwritten afterwards: from then on every flag reads the actual setting.
+	var resolved Config
+	fs := newFlagSet("check", &resolved)
+	resolved = *cfg
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		mark := " "
+		if value != f.DefValue {
+			mark = "*"
+		}
+		if secretFlags[f.Name] && value != "" {
+			value = "<set>"
+		}
+		fmt.Fprintf(w, "  %s -%s=%s\n", mark, f.Name, value)
+	})
+}
+
+// checkIngestAddr binds addr once, like udpListeners.bind. UDP ports are bound
+// without SO_REUSEPORT, so a running gateway with -udp-readers is found too.
+// An existing socket file isn't replaced, that would cut off a running gateway.
+func checkIngestAddr(network string, addr ingestAddr) error {
+	if addr.unix == nil {
+		conn, err := net.ListenUDP(network, addr.udp)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if info, err := os.Lstat(addr.unix.Name); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errors.New("file exists and isn't a socket")
+		}
+		// Startup replaces it, whether it is left over or in use can't be told from here.
+		return nil
+	}
+	conn, err := net.ListenUnixgram("unixgram", addr.unix)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	// Closing a datagram socket leaves its file behind, see udpListeners.Close.
+	return os.Remove(addr.unix.Name)
+}
+
+// checkTCPAddr binds a TCP address once.
+func checkTCPAddr(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"     // For stopping writePump
+	"fmt"         // For wrapping command validation errors
+	"log/slog"    // For structured logging
+	"net"         // For the UDP command socket
+	"sync/atomic" // For lock-free counters
+	"time"        // For ping intervals and deadlines
+
+	"github.com/gorilla/websocket"
+)
+
+// sendBufferSize is how many messages may queue up for a single client before
+// new messages for that client are dropped.
+const sendBufferSize = 256
+
+// Heartbeat tuning. A client that vanishes without closing its TCP connection
+// (laptop lid closed, cable pulled) is detected by a missing pong.
+// SYNTAX: a `const (...)` block declares several constants at once.
+const (
+	// pingPeriod is how often we ping every client.
+	pingPeriod = 30 * time.Second
+
+	// pongWait is how long we wait for a pong before declaring the client dead.
+	// It must be longer than pingPeriod.
+	pongWait = 40 * time.Second
+
+	// writeWait bounds how long writing a single message (or ping) may take.
+	// A client whose TCP connection is wedged for longer is treated as dead.
+	writeWait = 10 * time.Second
+)
+
+// Conn is the part of *websocket.Conn a Client uses. Clients (and therefore the
+// hub) only depend on this interface, so they can run on an in-memory fake
+// instead of a real network connection.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// SYNTAX: assigning to the blank identifier makes the compiler check that
+// *websocket.Conn implements Conn, without creating anything at runtime.
+var _ Conn = (*websocket.Conn)(nil)
+
+// Client is one connected WebSocket peer.
+// Every client has its own buffered `send` queue and a writer goroutine (writePump),
+// so a slow client only ever delays itself and never the whole broadcast.
+//
+// Lifecycle: a client uses exactly two goroutines, the HTTP handler running
+// readPump and writePump. Whichever side notices the end first takes the other down:
+//   - readPump fails (client closed, deadline, read limit): the handler
+//     unregisters the client, which closes `send` and ends writePump.
+//   - writePump fails or its context is canceled: it closes the connection,
+//     which makes readPump's ReadMessage fail, see above.
+//   - CloseAll (shutdown) closes `send` and the connection, ending both.
+//
+// So no path leaves a goroutine behind, whatever error ends the connection.
+type Client struct {
+	// id identifies the connection in logs (and to other parts of the gateway).
+	// IDs are assigned in connection order and never reused while the process runs.
+	id   uint64
+	conn Conn
+
+	// log is the default logger with this client's id and remote address attached,
+	// so every line about the client can be found with one filter.
+	log *slog.Logger
+
+	// untracked keeps the client out of the gateway-wide client metrics and
+	// the traffic totals of "/stats", for clients of an Untracked hub (the
+	// tap's, see tap.go). Set by serveClient before the pumps start.
+	untracked bool
+
+	// send is the outgoing message queue. Hub.Run pushes into it without blocking,
+	// writePump drains it. It is closed by Hub.Unregister.
+	send chan Message
+
+	// dropped counts messages discarded because `send` was full.
+	// A growing number means this client can't keep up with the stream.
+	// SYNTAX: atomic types can be updated from several goroutines without a mutex.
+	dropped atomic.Uint64
+
+	// Data frames and their payload bytes written to and read from the
+	// connection, for "/stats" (see stats.go). Updated by writePump and
+	// readPump, read by the stats handler. Control frames aren't counted.
+	messagesSent, bytesSent         atomic.Uint64
+	messagesReceived, bytesReceived atomic.Uint64
+
+	// connected is when the client was accepted.
+	connected time.Time
+
+	// subscription is the set of robot IDs this client wants, nil means "everything".
+	// It is replaced (never modified in place) by readPump and read by Hub.Run,
+	// an atomic pointer lets both sides do that without sharing a lock.
+	subscription atomic.Pointer[map[string]bool]
+
+	// filter is the client's field filter (see filter.go), nil means none.
+	// Replaced by readPump and read by Hub.Run like `subscription`.
+	filter atomic.Pointer[filter]
+
+	// maxHz limits how often broadcasts are handed to this client, keeping the
+	// newest one per robot in between (see decimate.go). 0 sends every message.
+	// It is the endpoint's rate, a client may ask for a lower one (see Hub.SetMaxHz).
+	maxHz float64
+
+	// dec holds back broadcasts at the client's current rate, nil without one.
+	// flush hands them over once they are due, nil while nothing is pending,
+	// flushes numbers the timers. All are guarded by the hub's mutex, see Hub.decimate.
+	dec     *decimator
+	flush   *time.Timer
+	flushes uint64
+
+	// ready is set once the client may receive broadcasts: right away, or with
+	// HubOptions.RequireHello once it has answered the hello. Until then queue
+	// skips it, only the snapshot queued by Register reaches it.
+	ready atomic.Bool
+
+	// paused is set while the client asked not to get broadcasts (see Hub.Pause).
+	// queue skips it like a client that isn't ready, pings go on as usual.
+	// Only changed under the hub's mutex, so a resume can't race with a broadcast.
+	paused atomic.Bool
+
+	// format is the frameFormat the client asked for, see format.go.
+	// Set from the subprotocol before Register, then written by readPump and read by writePump.
+	format atomic.Int32
+
+	// protocol is the negotiated WebSocket subprotocol, "" for none.
+	protocol string
+
+	// since is the Message.Seq of the last message a reconnecting client saw
+	// (0 = none), set by the handler before Register. resumed reports whether
+	// Register could send it only what it missed instead of a full snapshot.
+	since   uint64
+	resumed bool
+
+	// identity is who the client authenticated as (see requestIdentity), ""
+	// without -auth-token. Set by the handler before Register.
+	identity string
+
+	// room is the room the client is in, see room.go. Set by the handler before
+	// Register, later changed by Hub.Join. Guarded by the hub's mutex.
+	room string
+
+	// envelope is HubOptions.Envelope, for states re-encoded as JSON. Set by Register.
+	envelope bool
+
+	// dropOldest is HubOptions.DropOldest. Set by Register.
+	dropOldest bool
+
+	// batch and frame are reused by writePump for coalescing, see coalesce.go.
+	batch []Message
+	frame []byte
+
+	// reason is why the client is going away, nil while it isn't, see disconnect.go.
+	reason atomic.Pointer[string]
+}
+
+// nextClientID is the last handed out client id.
+var nextClientID atomic.Uint64
+
+// newClient wraps an upgraded connection. The caller must Register it with a hub
+// and start writePump. maxHz decimates the stream for this client, 0 disables it.
+func newClient(conn Conn, maxHz float64) *Client {
+	id := nextClientID.Add(1)
+	return &Client{
+		id:    id,
+		conn:  conn,
+		log:   slog.With("client", id, "remote", conn.RemoteAddr().String()),
+		send:  make(chan Message, sendBufferSize),
+		maxHz: maxHz,
+
+		connected: time.Now(),
+	}
+}
+
+// ID returns the client's connection id.
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+// Dropped returns how many messages this client has missed so far.
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// queue hands msg to the client's writePump. It never blocks: when the client's
+// buffer is full, it is lagging behind, and the message is dropped for this
+// client only instead of stalling everyone else. Which message is lost depends
+// on HubOptions.DropOldest: the new one, or the oldest one still waiting.
+// Clients that aren't ready yet or are paused are skipped, the message isn't counted as dropped.
+// The caller must hold the hub's mutex, so `send` can't be closed concurrently.
+func (c *Client) queue(msg Message) {
+	if !c.ready.Load() || c.paused.Load() {
+		return
+	}
+	// SYNTAX: a `select` with a `default` case makes the channel send non-blocking.
+	select {
+	case c.send <- msg:
+		return
+	default:
+	}
+	c.dropped.Add(1)
+	if !c.dropOldest {
+		return
+	}
+	// Make room by discarding the head of the queue. Only callers holding the
+	// hub's mutex add to `send`, so once one message is out the send can't fail.
+	// writePump may have taken one itself in the meantime, then ours is the
+	// one too many and the queue just ends up a message shorter.
+	select {
+	case <-c.send:
+	default:
+	}
+	select {
+	case c.send <- msg:
+	default:
+	}
+}
+
+// wants reports whether the client is subscribed to the given robot.
+func (c *Client) wants(id string) bool {
+	subs := c.subscription.Load()
+	return subs == nil || (*subs)[id]
+}
+
+// accepts reports whether the client wants the robot `id` in the state behind
+// `fields`: it is subscribed to it and it passes its filter.
+func (c *Client) accepts(id string, fields *stateFields) bool {
+	return c.wants(id) && c.matches(fields)
+}
+
+// takesAll reports whether the client neither subscribed to some robots nor set a filter.
+func (c *Client) takesAll() bool {
+	return c.subscription.Load() == nil && c.filter.Load() == nil
+}
+
+// matches reports whether the message behind `fields` passes the client's filter.
+// Messages that aren't a decoded robot state always do.
+func (c *Client) matches(fields *stateFields) bool {
+	f := c.filter.Load()
+	return f == nil || fields.state == nil || f.matches(fields)
+}
+
+// subscribe replaces the client's subscription. An empty list means "everything".
+func (c *Client) subscribe(ids []string) {
+	if len(ids) == 0 {
+		c.subscription.Store(nil)
+		return
+	}
+	subs := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		subs[id] = true
+	}
+	c.subscription.Store(&subs)
+}
+
+// newCommandLimiter returns a client's bucket for -cmd-rate, nil for no limit.
+// The burst equals one second's worth of commands, but at least one command:
+// with -cmd-rate 0.5 a smaller bucket could never hold the token a command costs.
+func newCommandLimiter(cmdRate float64) *tokenBucket {
+	if cmdRate <= 0 {
+		return nil
+	}
+	return newTokenBucket(cmdRate, max(cmdRate, 1))
+}
+
+// readPump reads from the connection until it fails. Control messages (see
+// protocol.go) are applied to the client, every other text or binary message
+// is an operator command and is forwarded unchanged to the simulation over opts.Commands,
+// or dropped if that is nil.
+// At most opts.CmdRate commands per second are forwarded (0 = unlimited), excess ones are dropped.
+// Commands with an "ack" id are retried and answered through `hub`, see commands.go.
+// The loop also processes control frames (pong, close) and notices when the
+// client goes away: ReadMessage returns an error once the connection is closed
+// by either side, the read deadline passes without a pong, or the client hasn't
+// sent a message for opts.IdleTimeout (0 = never idle).
+func (c *Client) readPump(hub *Hub, opts EndpointOptions) {
+	defer c.recoverClient("client reader", opts.RecoverPanics)
+	commands, cmdRate, idleTimeout := opts.Commands, opts.CmdRate, opts.IdleTimeout
+
+	// lastRead is when the client last sent a message. Pongs are automatic
+	// browser replies and don't count as activity.
+	lastRead := time.Now()
+
+	// extendDeadline moves the read deadline to whichever comes first: the next
+	// expected pong or the end of the idle period. If neither pongs nor messages
+	// arrive in time, the next ReadMessage fails with a timeout and the client is dropped.
+	extendDeadline := func() error {
+		deadline := time.Now().Add(pongWait)
+		if idle := lastRead.Add(idleTimeout); idleTimeout > 0 && idle.Before(deadline) {
+			deadline = idle
+		}
+		return c.conn.SetReadDeadline(deadline)
+	}
+	extendDeadline()
+	// The pong handler runs inside ReadMessage, on this goroutine.
+	c.conn.SetPongHandler(func(string) error {
+		return extendDeadline()
+	})
+
+	// Every client gets its own bucket, so one flooding client doesn't eat the others' budget.
+	limiter := newCommandLimiter(cmdRate)
+	// limited remembers that we already logged the current flood, so the log isn't flooded too.
+	limited := false
+
+	for {
+		msgType, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			reason := readFailure(err)
+			if reason == reasonMessageTooBig {
+				c.log.Warn("client sent a message over the size limit, disconnecting")
+			}
+			if idleTimeout > 0 && time.Since(lastRead) >= idleTimeout {
+				c.log.Info("client idle, disconnecting", "idle_timeout", idleTimeout.String())
+				writeClose(c.conn, websocket.ClosePolicyViolation, "idle timeout")
+				reason = reasonIdleTimeout
+			}
+			c.setReason(reason)
+			return
+		}
+		lastRead = time.Now()
+		extendDeadline()
+		c.messagesReceived.Add(1)
+		c.bytesReceived.Add(uint64(len(msg)))
+		if !c.untracked {
+			countReceived(len(msg))
+		}
+
+		// Control messages are JSON, so only text frames can be one.
+		// Binary frames are always commands.
+		if ctrl, ok := parseControl(msg); ok && msgType == websocket.TextMessage {
+			if ctrl.Subscribe != nil {
+				c.subscribe(*ctrl.Subscribe)
+				c.log.Debug("client subscribed", "robots", *ctrl.Subscribe)
+			}
+			// SYNTAX: Swap stores the new value and returns the old one, so only the first hello is logged.
+			if ctrl.Hello != nil && *ctrl.Hello && !c.ready.Swap(true) {
+				c.log.Debug("client ready")
+			}
+			if ctrl.Filter != nil {
+				if f, err := compileFilter(*ctrl.Filter); err != nil {
+					c.log.Debug("ignoring invalid filter", "err", err)
+				} else if len(f) == 0 {
+					c.filter.Store(nil)
+				} else {
+					c.filter.Store(&f)
+					c.log.Debug("client set filter", "conditions", len(f))
+				}
+			}
+			if ctrl.Format != nil {
+				if f, ok := parseFrameFormat(*ctrl.Format); ok {
+					c.format.Store(int32(f))
+					c.log.Debug("client picked format", "format", *ctrl.Format)
+				} else {
+					c.log.Debug("ignoring unknown format", "format", *ctrl.Format)
+				}
+			}
+			if ctrl.Room != nil {
+				if name := *ctrl.Room; !validRoomName(name) {
+					c.log.Debug("ignoring invalid room", "len", len(name))
+				} else if hub.Join(c, name) {
+					c.log.Debug("client joined room", "room", name)
+				}
+			}
+			if ctrl.Pause != nil && hub.Pause(c, *ctrl.Pause) {
+				c.log.Debug("client paused stream", "paused", *ctrl.Pause)
+			}
+			if ctrl.MaxHz != nil {
+				if hz := *ctrl.MaxHz; hz >= 0 {
+					hub.SetMaxHz(c, hz)
+					c.log.Debug("client requested rate", "max_hz", hz)
+				} else {
+					c.log.Debug("ignoring negative rate request", "max_hz", hz)
+				}
+			}
+			continue
+		}
+
+		// An endpoint without a command socket (the raw tap, see tap.go) is read-only.
+		if commands == nil {
+			c.log.Debug("ignoring command, endpoint is read-only")
+			if id, ok := ackID(msg); ok && msgType == websocket.TextMessage {
+				hub.Send(c, ackMessage(id, errReadOnly, hub.opts.Envelope))
+			}
+			continue
+		}
+
+		if limiter != nil && !limiter.allow() {
+			if !limited {
+				c.log.Warn("client exceeded command rate limit, dropping commands", "rate", cmdRate)
+				limited = true
+			}
+			continue
+		}
+		limited = false
+
+		if opts.ValidateCommands {
+			if err := validateCommand(msgType, msg); err != nil {
+				commandsRejected.Inc()
+				c.log.Debug("rejecting invalid command", "err", err)
+				if id, ok := ackID(msg); ok && msgType == websocket.TextMessage {
+					hub.Send(c, ackMessage(id, fmt.Errorf("invalid command: %w", err), hub.opts.Envelope))
+				} else {
+					hub.Send(c, errorMessage("invalid command: "+err.Error(), 1, hub.opts.Envelope))
+				}
+				continue
+			}
+		}
+
+		// UDP has no notion of text or binary, the raw bytes are forwarded as they are.
+		// A failed command write is the simulation's problem (not listening, restarting),
+		// not this client's, so we report it and keep the connection open.
+		// Only text frames can be JSON with an ack id.
+		if id, ok := ackID(msg); ok && msgType == websocket.TextMessage {
+			// The retries run on this goroutine, so the client's later commands
+			// wait for this one and reach the simulation in order.
+			err := sendReliable(commands, msg, opts.CmdRetries, opts.CmdTimeout)
+			if err != nil {
+				c.log.Warn("forwarding acknowledged command failed", "ack", string(id), "retries", opts.CmdRetries, "err", err)
+			}
+			hub.Send(c, ackMessage(id, err, hub.opts.Envelope))
+			continue
+		}
+		if _, err := commands.Write(msg); err != nil {
+			c.log.Warn("forwarding command failed", "err", err)
+		}
+	}
+}
+
+// writePump writes queued messages and periodic pings to the connection until
+// the queue is closed, a write fails or ctx is canceled. It is the only goroutine
+// that writes data frames to `conn`. readPump needs no context of its own:
+// it is blocked in ReadMessage, which fails as soon as writePump closes the connection.
+// It also watches how full `send` is and warns about a client that falls behind
+// (opts.SlowFill and opts.SlowAfter, see slow.go).
+func (c *Client) writePump(ctx context.Context, opts EndpointOptions) {
+	ticker := time.NewTicker(pingPeriod)
+	// slowCheck is nil (and never ready) without slow consumer warnings.
+	var slowTicker *time.Ticker
+	var slowCheck <-chan time.Time
+	slow := newSlowWatch(cap(c.send), opts.SlowFill, opts.SlowAfter)
+	if slow != nil {
+		slowTicker = time.NewTicker(slow.interval())
+		slowCheck = slowTicker.C
+	}
+	// Closing the connection unblocks readPump, which then unregisters the client.
+	defer func() {
+		ticker.Stop()
+		if slowTicker != nil {
+			slowTicker.Stop()
+		}
+		c.conn.Close()
+	}()
+	// Deferred after the close above, so it runs first and the close frame still goes out.
+	defer c.recoverClient("client writer", opts.RecoverPanics)
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			// `ok` is false once Hub.Unregister has closed the queue.
+			if !ok {
+				return
+			}
+			if slow != nil {
+				// +1 for the message just taken out.
+				slow.observe(len(c.send) + 1)
+			}
+			if opts.Coalesce < 2 {
+				if !c.write(msg) {
+					return
+				}
+				continue
+			}
+			batch, closed := c.drain(msg, opts.Coalesce)
+			if !c.writeAll(batch, opts.Coalesce) || closed {
+				return
+			}
+		case now := <-slowCheck:
+			c.checkSlow(slow, now)
+		case <-ctx.Done():
+			c.setReason(reasonShutdown)
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				c.log.Debug("ping to client failed", "err", err)
+				c.setReason(reasonWriteError)
+				return
+			}
+		}
+	}
+}
+
+// checkSlow logs a warning if w says the client has been falling behind for too long.
+func (c *Client) checkSlow(w *slowWatch, now time.Time) {
+	if warn, peak, lasted := w.check(len(c.send), now); warn {
+		c.log.Warn("slow consumer, send queue filling up", "peak_queued", peak, "capacity", cap(c.send),
+			"for", lasted.Round(100*time.Millisecond).String(), "dropped", c.Dropped())
+		slowConsumerWarnings.Inc()
+	}
+}
+
+// write sends one message as a data frame of its own. It returns false if the client should be dropped.
+func (c *Client) write(msg Message) bool {
+	msg = reformat(msg, frameFormat(c.format.Load()), c.envelope)
+	return c.writeFrame(msg.Type, msg.Data, msg)
+}
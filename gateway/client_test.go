@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientQueueDropPolicy(t *testing.T) {
+	const extra = 3
+	tests := []struct {
+		name       string
+		dropOldest bool
+		// first and last are the frame numbers left at the head and the tail of the full queue.
+		first, last int
+	}{
+		{name: "newest", dropOldest: false, first: 0, last: sendBufferSize - 1},
+		{name: "oldest", dropOldest: true, first: extra, last: sendBufferSize + extra - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newClient(newFakeConn(), 0)
+			client.ready.Store(true)
+			client.dropOldest = tt.dropOldest
+			for i := range sendBufferSize + extra {
+				client.queue(Message{Type: websocket.TextMessage, Data: frame(i)})
+			}
+
+			if got := client.Dropped(); got != extra {
+				t.Errorf("Dropped() = %d, want %d", got, extra)
+			}
+			if n := len(client.send); n != sendBufferSize {
+				t.Fatalf("queue holds %d messages, want %d", n, sendBufferSize)
+			}
+			// The queue stays in order whichever end lost messages.
+			for i := tt.first; i <= tt.last; i++ {
+				if msg := <-client.send; !bytes.Equal(msg.Data, frame(i)) {
+					t.Fatalf("queued %s, want %s", msg.Data, frame(i))
+				}
+			}
+		})
+	}
+}
+
+// Paused clients and ones that haven't said hello get nothing, and that isn't a drop.
+func TestClientQueueSkipsIdleClients(t *testing.T) {
+	notReady := newClient(newFakeConn(), 0)
+	paused := newClient(newFakeConn(), 0)
+	paused.ready.Store(true)
+	paused.paused.Store(true)
+	for _, client := range []*Client{notReady, paused} {
+		client.queue(Message{Type: websocket.TextMessage, Data: frame(0)})
+		if n, dropped := len(client.send), client.Dropped(); n != 0 || dropped != 0 {
+			t.Errorf("client %d: %d queued and %d dropped, want neither", client.ID(), n, dropped)
+		}
+	}
+}
+
+// -cmd-rate is a float, below 1 a client gets one command every 1/rate seconds
+// instead of none at all.
+func TestCommandLimiterFractionalRate(t *testing.T) {
+	if newCommandLimiter(0) != nil {
+		t.Error("-cmd-rate 0 got a limiter, want none")
+	}
+	for _, rate := range []float64{0.5, 0.1} {
+		limiter := newCommandLimiter(rate)
+		if !limiter.allow() {
+			t.Fatalf("rate %v: first command refused", rate)
+		}
+		if limiter.allow() {
+			t.Errorf("rate %v: second command right away allowed", rate)
+		}
+		// As if 2/rate seconds had passed, the bucket still holds only one command.
+		limiter.last = limiter.last.Add(-time.Duration(2 * float64(time.Second) / rate))
+		if !limiter.allow() {
+			t.Errorf("rate %v: command after 1/rate seconds refused", rate)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time" // For the write deadline
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Write Coalescing ---
+// Every WebSocket frame is at least one write syscall. A client that falls a
+// little behind has several frames waiting in its queue, with -coalesce they go
+// out as one text frame holding a JSON array of them, e.g.
+// [{"type":"state","seq":7,"payload":{...}},{"type":"state","seq":8,"payload":{...}}].
+// That needs -envelope: every frame is an object saying what it is, so a client
+// only has to check whether a frame starts with "[" and handle its elements one by one.
+// A client that keeps up never gets an array, its queue holds one message at a time.
+
+// batchable reports whether msg can go into a batch: a text frame holding a
+// JSON object, which an envelope always is. Anything else (binary frames,
+// payloads that weren't JSON and so never got wrapped) is written on its own.
+func batchable(msg Message) bool {
+	return msg.Type == websocket.TextMessage && len(msg.Data) > 0 && msg.Data[0] == '{'
+}
+
+// drain returns msg followed by whatever else is already waiting in `send`,
+// up to `limit` messages in total, without blocking. closed reports that
+// `send` was closed while draining, the caller must stop after writing the batch.
+func (c *Client) drain(msg Message, limit int) (batch []Message, closed bool) {
+	batch = append(c.batch[:0], msg)
+	// SYNTAX: the deferred function runs after `batch` got its final value, it keeps the (possibly grown) array for next time.
+	defer func() { c.batch = batch }()
+	for len(batch) < limit {
+		select {
+		case next, ok := <-c.send:
+			if !ok {
+				return batch, true
+			}
+			batch = append(batch, next)
+		default:
+			return batch, false
+		}
+	}
+	return batch, false
+}
+
+// writeAll writes msgs in order. With coalescing on, consecutive batchable
+// frames are joined into arrays of at most `limit` (a limit below 2 writes
+// every message on its own). It returns false if the client should be dropped.
+func (c *Client) writeAll(msgs []Message, limit int) bool {
+	for len(msgs) > 0 {
+		// Frames are batched in the format they are sent in, see format.go.
+		first := reformat(msgs[0], frameFormat(c.format.Load()), c.envelope)
+		if limit < 2 || len(msgs) == 1 || !batchable(first) {
+			if !c.write(msgs[0]) {
+				return false
+			}
+			msgs = msgs[1:]
+			continue
+		}
+		frame := append(c.frame[:0], '[')
+		frame = append(frame, first.Data...)
+		n := 1
+		for n < len(msgs) && n < limit {
+			next := reformat(msgs[n], frameFormat(c.format.Load()), c.envelope)
+			if !batchable(next) {
+				break
+			}
+			frame = append(frame, ',')
+			frame = append(frame, next.Data...)
+			n++
+		}
+		frame = append(frame, ']')
+		// Kept for the next batch, WriteMessage is done with it once it returns.
+		c.frame = frame
+		if n == 1 {
+			// The only batchable frame was followed by one that isn't.
+			if !c.write(msgs[0]) {
+				return false
+			}
+		} else {
+			if !c.writeFrame(websocket.TextMessage, frame, msgs[:n]...) {
+				return false
+			}
+			messagesCoalesced.Add(float64(n))
+		}
+		msgs = msgs[n:]
+	}
+	return true
+}
+
+// writeFrame writes one data frame carrying `msgs`, which are only used for
+// the latency metric. It returns false if the client should be dropped.
+func (c *Client) writeFrame(msgType int, data []byte, msgs ...Message) bool {
+	// Without a deadline a wedged socket would block this goroutine forever.
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.conn.WriteMessage(msgType, data); err != nil {
+		// Timeouts end up here too: the client is dropped like any failed one.
+		c.log.Debug("write to client failed", "err", err)
+		c.setReason(reasonWriteError)
+		return false
+	}
+	c.messagesSent.Add(1)
+	c.bytesSent.Add(uint64(len(data)))
+	if c.untracked {
+		return true
+	}
+	countSent(len(data))
+	for _, msg := range msgs {
+		if !msg.Received.IsZero() {
+			observeDelivery(time.Since(msg.Received))
+		}
+	}
+	return true
+}
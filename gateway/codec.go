@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json" // For the default wire format
+	"fmt"           // For the unknown codec error
+	"slices"        // For listing codec names
+	"strings"       // For joining codec names
+
+	"gateway/robotpb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec is a wire format for robot states. Everything that reads or writes
+// RobotState packets goes through one, so switching the simulation to a
+// different format only means adding an implementation here.
+type Codec interface {
+	// Decode parses and validates one packet.
+	Decode(packet []byte) (RobotState, error)
+	// Encode serializes one state into a packet.
+	Encode(state RobotState) ([]byte, error)
+}
+
+// jsonCodec is the default format, e.g. {"id":"robot_1","x":1.0,...}.
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(packet []byte) (RobotState, error) {
+	return decodeRobotState(packet)
+}
+
+func (jsonCodec) Encode(state RobotState) ([]byte, error) {
+	return json.Marshal(state)
+}
+
+// protobufCodec is the format the embedded robots emit, defined in
+// robotpb/robot_state.proto. After changing the .proto, regenerate the Go code
+// with `go generate` (needs protoc and protoc-gen-go on the PATH).
+type protobufCodec struct{}
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative robotpb/robot_state.proto
+
+func (protobufCodec) Decode(packet []byte) (RobotState, error) {
+	var pb robotpb.RobotState
+	if err := proto.Unmarshal(packet, &pb); err != nil {
+		return RobotState{}, err
+	}
+	state := RobotState{
+		ID:        pb.Id,
+		X:         pb.X,
+		Y:         pb.Y,
+		Heading:   pb.Heading,
+		Timestamp: pb.Timestamp,
+		Seq:       pb.Seq,
+	}
+	if state.ID == "" {
+		return state, errMissingID
+	}
+	return state, nil
+}
+
+func (protobufCodec) Encode(state RobotState) ([]byte, error) {
+	return proto.Marshal(&robotpb.RobotState{
+		Id:        state.ID,
+		X:         state.X,
+		Y:         state.Y,
+		Heading:   state.Heading,
+		Timestamp: state.Timestamp,
+		Seq:       state.Seq,
+	})
+}
+
+// codecs lists the formats -codec accepts, by name.
+var codecs = map[string]Codec{
+	"json":     jsonCodec{},
+	"protobuf": protobufCodec{},
+}
+
+// codecByName returns the codec called `name`.
+func codecByName(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		names := make([]string, 0, len(codecs))
+		for n := range codecs {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("unknown codec %q, want one of: %s", name, strings.Join(names, ", "))
+	}
+	return codec, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+// benchState is a typical robot state, with the optional sequence number set.
+var benchState = func() RobotState {
+	seq := uint32(1234)
+	return RobotState{ID: "robot_7", X: 12.345678, Y: -3.210987, Heading: 1.5707963, Timestamp: 1760000000000, Seq: &seq}
+}()
+
+// benchmarkDecode decodes the same packet in `codec`'s format over and over.
+func benchmarkDecode(b *testing.B, codec Codec) {
+	packet, err := codec.Encode(benchState)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := codec.Decode(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B)     { benchmarkDecode(b, jsonCodec{}) }
+func BenchmarkDecodeProtobuf(b *testing.B) { benchmarkDecode(b, protobufCodec{}) }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"         // For the cheap "is it an object" check
+	"encoding/json" // For reading the ack id and writing the reply
+	"errors"        // For validation errors
+	"fmt"           // For validation errors with details
+	"net"           // For the command socket
+	"time"          // For spacing the attempts
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Reliable Commands ---
+// Commands are forwarded over UDP, which may lose them without anyone noticing.
+// That's fine for "move a bit to the left", not for "stop robot". A client that
+// needs to know adds an "ack" key with an id of its choice to a JSON command:
+//
+//	-> {"ack":"c-17","cmd":"stop","robot":"robot_3"}
+//	<- {"type":"ack","ack":"c-17"}                 once the command was sent
+//	<- {"type":"ack","ack":"c-17","error":"..."}   if every attempt failed
+//
+// The command is forwarded unchanged (ack id included, so the simulation can
+// drop duplicates). A failed send is retried CmdRetries times, spread over
+// CmdTimeout. UDP only reports some failures (e.g. "connection refused" once
+// the kernel learned that nothing listens on the port), so an ack means the
+// command left the gateway, not that the simulation executed it.
+
+// ackFrame is the reply to a reliable command.
+type ackFrame struct {
+	Type string `json:"type,omitempty"`
+	// SYNTAX: json.RawMessage echoes the id exactly as the client sent it, string or number.
+	Ack   json.RawMessage `json:"ack"`
+	Error string          `json:"error,omitempty"`
+}
+
+// ackID returns the "ack" id of a JSON object command, false if it has none.
+func ackID(msg []byte) (json.RawMessage, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		return nil, false
+	}
+	var cmd struct {
+		Ack json.RawMessage `json:"ack"`
+	}
+	if err := json.Unmarshal(msg, &cmd); err != nil || len(cmd.Ack) == 0 || string(cmd.Ack) == "null" {
+		return nil, false
+	}
+	return cmd.Ack, true
+}
+
+// errReadOnly answers acknowledged commands sent to an endpoint without a
+// command socket, like "/ws/raw" (see readPump).
+var errReadOnly = errors.New("this endpoint doesn't forward commands")
+
+// ackMessage builds the reply to the command with the given id, wrapped if
+// `wrap` is set. A nil err acknowledges the command, otherwise it is reported as failed.
+func ackMessage(id json.RawMessage, err error, wrap bool) Message {
+	frame := ackFrame{Type: typeAck, Ack: id}
+	if err != nil {
+		frame.Error = err.Error()
+	}
+	if wrap {
+		frame.Type = ""
+	}
+	// The id came out of json.Unmarshal, so it is valid JSON and this can't fail.
+	data, _ := json.Marshal(frame)
+	if wrap {
+		data = wrapEnvelope(typeAck, data)
+	}
+	return Message{Type: websocket.TextMessage, Data: data}
+}
+
+// sendReliable writes msg to conn, retrying up to `retries` times if that fails.
+// The attempts are spread evenly over `timeout`. It returns the last error if none succeeded.
+func sendReliable(conn *net.UDPConn, msg []byte, retries int, timeout time.Duration) error {
+	delay := timeout / time.Duration(retries+1)
+	var err error
+	for attempt := range retries + 1 {
+		if attempt > 0 {
+			time.Sleep(delay)
+		}
+		if _, err = conn.Write(msg); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// --- Command Validation ---
+// With -validate-commands only commands that are a Command are forwarded, so a
+// buggy or hostile page can't put garbage on the robots' wire:
+//
+//	-> {"cmd":"move","robot":"robot_3","args":{"dx":0.5}}   forwarded
+//	-> {"cmd":"stop"}                                        not forwarded
+//	<- {"type":"error","detail":"invalid command: \"robot\" is required","count":1}
+//
+// A rejected command that asked for an ack gets a failed ack (see above) instead of the error frame.
+
+// maxCommandNameLen bounds Command.Cmd.
+const maxCommandNameLen = 64
+
+// Command is the shape every command must have with -validate-commands.
+// Fields not listed here are rejected, a typo like "robto" must not pass as
+// a command for no robot in particular.
+type Command struct {
+	// Cmd is what to do, e.g. "move" or "stop". Required.
+	Cmd string `json:"cmd"`
+	// Robot is the ID of the robot to do it. Required.
+	Robot string `json:"robot"`
+	// Args are the command's parameters, if any. It must be a JSON object.
+	Args json.RawMessage `json:"args,omitempty"`
+	// Ack asks for an acknowledgement, see ackID.
+	Ack json.RawMessage `json:"ack,omitempty"`
+}
+
+// errNotJSONCommand is returned by validateCommand for frames that can't be a Command at all.
+var errNotJSONCommand = errors.New("commands must be JSON text frames")
+
+// validateCommand checks that a command frame is a valid Command.
+func validateCommand(msgType int, msg []byte) error {
+	if msgType != websocket.TextMessage {
+		return errNotJSONCommand
+	}
+	var cmd Command
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cmd); err != nil {
+		return err
+	}
+	// Decode stops after the first value, `{...} garbage` would pass otherwise.
+	if dec.More() {
+		return errors.New("trailing data after the command")
+	}
+	switch {
+	case cmd.Cmd == "":
+		return errors.New(`"cmd" is required`)
+	case len(cmd.Cmd) > maxCommandNameLen:
+		return fmt.Errorf(`"cmd" is longer than %d bytes`, maxCommandNameLen)
+	case cmd.Robot == "":
+		return errors.New(`"robot" is required`)
+	case len(cmd.Args) > 0 && !bytes.HasPrefix(bytes.TrimSpace(cmd.Args), []byte("{")):
+		return errors.New(`"args" must be an object`)
+	}
+	return nil
+}
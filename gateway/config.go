@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"   // For telling environment errors from flag errors
+	"flag"     // For the command-line flags
+	"fmt"      // For error messages
+	"log/slog" // For the log level type
+	"os"       // For the usage output
+	"strings"  // For deriving environment variable names
+	"time"     // For durations
+)
+
+// --- Configuration ---
+// Every setting is a command-line flag and, for containerized deploys, also an
+// environment variable: the flag name upper-cased, with "-" replaced by "_" and
+// prefixed with GATEWAY_, e.g. -ws-addr is GATEWAY_WS_ADDR. An explicitly passed
+// flag wins over the variable, the variable wins over the default.
+
+// envPrefix is put in front of every environment variable name, see envName.
+const envPrefix = "GATEWAY_"
+
+// errInvalidEnv is wrapped by loadConfig's errors about environment variables.
+var errInvalidEnv = errors.New("invalid environment variable")
+
+// Config is everything the gateway can be configured with, see loadConfig.
+type Config struct {
+	Check            bool
+	AdminAddr        string
+	StatsClients     bool
+	WSAddr           string
+	TCPAddr          string
+	UDPAddr          string
+	UDPAllow         string
+	TagSource        bool
+	CmdAddr          string
+	CmdRate          float64
+	ValidateCommands bool
+	CmdRetries       int
+	CmdTimeout       time.Duration
+	MaxMessageSize   int64
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+	SlowFill         float64
+	SlowAfter        time.Duration
+	Coalesce         bool
+	CoalesceMax      int
+	BroadcastWorkers int
+	HistorySize      int
+	HistoryMaxAge    time.Duration
+	Delta            bool
+	KeyframeInterval time.Duration
+	Dedup            bool
+	Envelope         bool
+	Pipeline         string
+	Heartbeat        time.Duration
+	MaxClients       int
+	MaxRooms         int
+	RequireHello     bool
+	Binary           bool
+	UDPNetwork       string
+	UDPReaders       int
+	UDPRetry         time.Duration
+	UDPReadTimeout   time.Duration
+	SilenceTimeout   time.Duration
+	UDPBuffer        int
+	UDPMaxPPS        float64
+	UDPMaxBPS        float64
+	Sample           int
+	RecordPath       string
+	ReplayPath       string
+	ReplaySpeed      float64
+	ReplayLoop       bool
+	Codec            string
+	ToJSON           bool
+	Strict           bool
+	ErrorFrames      bool
+	Sanitize         bool
+	SanitizeBound    float64
+	MaxHz            float64
+	QueueSize        int
+	QueueRetry       time.Duration
+	DropPolicy       string
+	CloseGrace       time.Duration
+	RecoverPanics    bool
+	CacheLast        bool
+	AuthToken        string
+	SingleSession    string
+	AllowedOrigins   string
+	Compress         bool
+	WSReadBuffer     int
+	WSWriteBuffer    int
+	WSBufferPool     bool
+	TLSCert          string
+	TLSKey           string
+	Gen              bool
+	GenTarget        string
+	GenRobots        int
+	GenHz            float64
+	LogLevel         slog.Level
+}
+
+// newFlagSet returns the gateway's flags, bound to the fields of cfg.
+// The defaults match the ports used in compose.yaml, so running without flags behaves as before.
+func newFlagSet(name string, cfg *Config) *flag.FlagSet {
+	// SYNTAX: ContinueOnError makes Parse return errors instead of exiting, so loadConfig can be called from tests.
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	// SYNTAX: `fs.StringVar` stores the flag's value in the given variable when `fs.Parse` runs.
+	fs.BoolVar(&cfg.Check, "check", false, "validate the configuration, try binding every address, print the result and exit (0 = ok)")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", "", "address for the admin server with metrics, stats, probes, pprof and /notify, e.g. localhost:6060 (empty = off)")
+	fs.BoolVar(&cfg.StatsClients, "stats-clients", false, "list every connected client with its byte and message counters in /stats")
+	fs.StringVar(&cfg.WSAddr, "ws-addr", ":8080", "address for the WebSocket (HTTP) server") // inside port of the docker container
+	fs.StringVar(&cfg.TCPAddr, "tcp-addr", "", "address for clients that read length-prefixed frames over TCP instead of WebSocket, with TLS if -tls-cert is set (empty = off)")
+	fs.StringVar(&cfg.UDPAddr, "udp-addr", ":8000", "address(es) to receive simulation UDP packets on, comma-separated, unixgram:/path for a Unix datagram socket, room=address for a room's packets")
+	fs.StringVar(&cfg.UDPAllow, "udp-allow", "", "comma-separated IPs and CIDR ranges UDP packets are accepted from (empty = any sender)")
+	fs.BoolVar(&cfg.TagSource, "tag-source", false, "add the receiving UDP port as a \"shard\" and the sender's IP:port as a \"source\" field to JSON packets")
+	fs.StringVar(&cfg.CmdAddr, "cmd-addr", "127.0.0.1:8001", "simulation address that operator commands are forwarded to (UDP)")
+	fs.BoolVar(&cfg.ValidateCommands, "validate-commands", false, "only forward commands shaped like {\"cmd\":...,\"robot\":...,\"args\":{...}}, reject others with an error frame")
+	fs.Float64Var(&cfg.CmdRate, "cmd-rate", 50, "maximum commands per second forwarded from each client (0 = unlimited)")
+	fs.IntVar(&cfg.CmdRetries, "cmd-retries", 3, `retries for forwarding a command with an "ack" id that failed to send`)
+	fs.DurationVar(&cfg.CmdTimeout, "cmd-timeout", time.Second, `time the retries of a command with an "ack" id are spread over`)
+	fs.Int64Var(&cfg.MaxMessageSize, "max-message-size", 1<<20, "largest message in bytes a client may send, larger ones close the connection (0 = no limit, TCP clients are always held to 16 MiB)")
+	fs.DurationVar(&cfg.HandshakeTimeout, "handshake-timeout", 10*time.Second, "how long a client may take to complete the WebSocket handshake")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 5*time.Minute, "disconnect clients that send nothing for this long (0 = never)")
+	fs.Float64Var(&cfg.SlowFill, "slow-fill", 0.75, "fraction of a client's send queue that counts as falling behind, see -slow-after")
+	fs.BoolVar(&cfg.Coalesce, "coalesce", false, "send frames that queued up for a client as one JSON array frame (needs -envelope)")
+	fs.IntVar(&cfg.CoalesceMax, "coalesce-max", 32, "most frames joined into one with -coalesce")
+	fs.DurationVar(&cfg.SlowAfter, "slow-after", 5*time.Second, "warn about clients whose send queue stays over -slow-fill for this long (0 = never)")
+	fs.IntVar(&cfg.BroadcastWorkers, "broadcast-workers", 1, "goroutines that hand each message to the clients, useful with thousands of clients on several cores")
+	fs.IntVar(&cfg.HistorySize, "history", 0, "replay the last N messages of every robot to new clients (0 = off)")
+	fs.DurationVar(&cfg.HistoryMaxAge, "history-max-age", 30*time.Second, "leave history messages older than this out of the replay (0 = any age)")
+	fs.BoolVar(&cfg.Delta, "delta", false, "only send robot states whose pose changed, plus periodic keyframes with all robots")
+	fs.DurationVar(&cfg.KeyframeInterval, "keyframe-interval", 5*time.Second, "how often -delta sends a keyframe (0 = only to new clients)")
+	fs.BoolVar(&cfg.Dedup, "dedup", false, "skip messages that repeat the previous payload of the same robot")
+	fs.BoolVar(&cfg.Envelope, "envelope", false, `wrap every message sent to clients as {"type":...,"payload":...}`)
+	fs.StringVar(&cfg.Pipeline, "pipeline", defaultPipeline, "order of the stages every broadcast runs through: -dedup, -delta, then the per-client filter and decimate, -envelope last (a stage left out is off)")
+	fs.DurationVar(&cfg.Heartbeat, "heartbeat", 0, "send clients a heartbeat message after this long without data (0 = never)")
+	fs.IntVar(&cfg.MaxClients, "max-clients", 1000, "maximum number of concurrent WebSocket clients (0 = unlimited)")
+	fs.IntVar(&cfg.MaxRooms, "max-rooms", 64, "most rooms packets may create with a \"room\" field besides the -udp-addr ones, packets for others are dropped (0 = unlimited)")
+	fs.BoolVar(&cfg.RequireHello, "require-hello", false, `send new clients {"type":"hello",...} and no broadcasts until they reply {"hello":true}`)
+	fs.BoolVar(&cfg.Binary, "binary", false, "send every UDP payload as a binary WebSocket frame (default: binary only if not valid UTF-8)")
+	fs.StringVar(&cfg.UDPNetwork, "udp-network", "udp", "network for -udp-addr: udp (IPv4 and IPv6), udp4 or udp6")
+	fs.IntVar(&cfg.UDPReaders, "udp-readers", 1, "sockets (SO_REUSEPORT, Linux only) and reader goroutines per UDP address, for hosts where one reader can't keep up")
+	fs.DurationVar(&cfg.UDPRetry, "udp-retry", 30*time.Second, "keep retrying to bind a UDP address that is in use for this long")
+	fs.DurationVar(&cfg.UDPReadTimeout, "udp-read-timeout", 5*time.Second, "wake up UDP readers that got nothing for this long, an address silent for as long is logged (0 = block until a packet arrives)")
+	fs.DurationVar(&cfg.SilenceTimeout, "silence-timeout", 0, "warn and mark the stream unhealthy in /stats once no packet has arrived for this long, with -error-frames tell clients too (0 = off)")
+	fs.IntVar(&cfg.UDPBuffer, "udp-buffer", maxUDPPayload, "UDP read buffer size in bytes (at most 65535), larger packets are truncated")
+	fs.IntVar(&cfg.Sample, "sample", 1, "only broadcast every Nth packet of each UDP address, the others just refresh the cached last state")
+	fs.Float64Var(&cfg.UDPMaxPPS, "udp-max-pps", 0, "packets per second each UDP address accepts, excess ones are dropped (0 = unlimited)")
+	fs.Float64Var(&cfg.UDPMaxBPS, "udp-max-bps", 0, "bytes per second each UDP address accepts, excess packets are dropped (0 = unlimited)")
+	fs.StringVar(&cfg.RecordPath, "record", "", "append every received UDP packet to this file for later replay, gzip compressed if it ends in .gz")
+	fs.StringVar(&cfg.ReplayPath, "replay", "", "play a file written by -record instead of listening for UDP")
+	fs.Float64Var(&cfg.ReplaySpeed, "replay-speed", 1, "playback speed multiplier for -replay (2 = twice as fast)")
+	fs.BoolVar(&cfg.ReplayLoop, "replay-loop", false, "start -replay over when the end of the file is reached")
+	fs.StringVar(&cfg.Codec, "codec", "json", "wire format of the robot states sent by the simulation (json, protobuf)")
+	fs.BoolVar(&cfg.ToJSON, "to-json", false, "re-encode decoded robot states as JSON before sending them to clients")
+	fs.BoolVar(&cfg.Strict, "strict", false, "drop UDP packets that aren't valid robot state JSON instead of forwarding them")
+	fs.BoolVar(&cfg.ErrorFrames, "error-frames", false, `tell clients about packets dropped by -strict (at most once a second) and about -silence-timeout with {"type":"error",...}`)
+	fs.BoolVar(&cfg.Sanitize, "sanitize", false, "clamp robot coordinates to ±-sanitize-bound and drop states with NaN or infinite values")
+	fs.Float64Var(&cfg.SanitizeBound, "sanitize-bound", 1e6, "largest absolute coordinate -sanitize lets through")
+	fs.Float64Var(&cfg.MaxHz, "max-hz", 10, "update rate of /ws/lite clients in messages per second and robot, keeping only the latest (0 = no limit)")
+	fs.IntVar(&cfg.QueueSize, "queue-size", 256, "messages buffered between UDP ingest and the broadcaster, extra ones are dropped")
+	fs.BoolVar(&cfg.RecoverPanics, "recover-panics", true, "log panics in the broadcaster and UDP readers and restart them, and drop clients whose goroutines panic, instead of crashing")
+	fs.DurationVar(&cfg.CloseGrace, "close-grace", 0, `on shutdown, tell clients {"type":"restart",...} this long before closing them with 1012 (0 = close right away with 1001)`)
+	fs.StringVar(&cfg.DropPolicy, "drop-policy", "newest", "what a lagging client loses when its queue is full: the \"newest\" message (keeps order) or the \"oldest\" (keeps data fresh)")
+	fs.DurationVar(&cfg.QueueRetry, "queue-retry", 0, "how long a message may wait for room in a full broadcast queue before it is dropped, e.g. 2ms (0 = drop right away)")
+	fs.BoolVar(&cfg.CacheLast, "cache-last", true, "send the most recent message to clients as soon as they connect")
+	fs.StringVar(&cfg.AuthToken, "auth-token", "", "require this token (?token= or Authorization: Bearer) to open a WebSocket, or one of several comma-separated ones, optionally named like alice:s3cret")
+	fs.StringVar(&cfg.SingleSession, "single-session", sessionsOff, "one connection per -auth-token identity: off, reject a second one, or replace the first one")
+	fs.StringVar(&cfg.AllowedOrigins, "allowed-origins", "*", "comma-separated browser origins allowed to connect, \"*\" allows any")
+	fs.BoolVar(&cfg.Compress, "compress", false, "negotiate permessage-deflate compression with clients that support it")
+	fs.IntVar(&cfg.WSReadBuffer, "ws-read-buffer", 0, "WebSocket read buffer size per connection in bytes (0 = 4096)")
+	fs.IntVar(&cfg.WSWriteBuffer, "ws-write-buffer", 0, "WebSocket write buffer size in bytes (0 = 4096)")
+	fs.BoolVar(&cfg.WSBufferPool, "ws-buffer-pool", false, "share write buffers between connections instead of giving each its own, saves memory with many mostly idle clients")
+	// Setting both TLS flags serves wss:// (needed when the page itself is served over HTTPS).
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file (PEM), enables wss:// together with -tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file (PEM), enables wss:// together with -tls-cert")
+	// -gen turns this binary into a stand-in for the simulation, see gen.go.
+	fs.BoolVar(&cfg.Gen, "gen", false, "don't run the gateway, send synthetic robot states to -gen-target instead")
+	fs.StringVar(&cfg.GenTarget, "gen-target", "127.0.0.1:8000", "UDP address -gen sends to")
+	fs.IntVar(&cfg.GenRobots, "gen-robots", 5, "number of robots -gen simulates")
+	fs.Float64Var(&cfg.GenHz, "gen-hz", 60, "packets per second and robot sent by -gen")
+	// SYNTAX: `TextVar` fills any type that can parse itself from text, slog.Level understands "debug", "info", "warn", "error".
+	fs.TextVar(&cfg.LogLevel, "log-level", slog.LevelInfo, "minimum log level (debug, info, warn, error)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", name)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set with an environment variable, e.g. -ws-addr as %s.\n", envName("ws-addr"))
+	}
+	return fs
+}
+
+// envName returns the environment variable for the flag called `name`.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig builds the configuration from the defaults, the environment
+// (looked up with getenv, os.Getenv in production) and the command-line
+// arguments, in that order of increasing priority.
+func loadConfig(name string, args []string, getenv func(string) string) (*Config, error) {
+	cfg := &Config{}
+	fs := newFlagSet(name, cfg)
+
+	// Environment variables are applied like flags given before all others,
+	// so anything on the actual command line is parsed later and overrides them.
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value := getenv(envName(f.Name))
+		if value == "" || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%w %s=%q: %v", errInvalidEnv, envName(f.Name), value, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// mustLoadConfig is loadConfig for `main`: invalid settings end the program, -h exits cleanly.
+func mustLoadConfig() *Config {
+	cfg, err := loadConfig(os.Args[0], os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		// The flag set has already printed command-line errors, together with the usage text.
+		if errors.Is(err, errInvalidEnv) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+	return cfg
+}
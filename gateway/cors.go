@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http" // For the middleware
+	"strconv"  // For the max-age header
+	"time"     // For how long browsers may cache a preflight
+)
+
+// --- CORS ---
+// A dashboard served from another origin can only fetch "/snapshot" and "/stats"
+// if the response says its origin may read it. The origins are the same
+// -allowed-origins list that CheckOrigin uses for "/ws". The WebSocket paths
+// don't need this, browsers don't apply CORS to WebSocket handshakes.
+
+// preflightMaxAge is how long a browser may reuse a preflight answer.
+const preflightMaxAge = 10 * time.Minute
+
+// withCORS adds CORS headers to next's responses for allowed origins and
+// answers preflight requests (OPTIONS with Access-Control-Request-Method) itself.
+// It goes outside requireToken: browsers send preflights without credentials,
+// the request that follows carries the token.
+// Requests from origins that aren't allowed still reach next, just without the
+// headers, so the browser won't let the page read the answer.
+func withCORS(origins originSet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		// Responses differ by Origin, caches must not hand one origin's answer to another.
+		w.Header().Add("Vary", "Origin")
+		allowed := origin != "" && origins.allow(r)
+		if allowed {
+			// The origin itself rather than "*", which couldn't be combined with credentials.
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		// Authorization is how requireToken's bearer token is sent.
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(preflightMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithCORS(t *testing.T) {
+	tokens, err := parseAuthTokens("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like "/snapshot": the token check sits inside withCORS.
+	reached := false
+	next := requireToken(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	srv := httptest.NewServer(withCORS(parseOrigins("http://localhost:5173"), next))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool // sends Access-Control-Request-Method
+		token       bool
+		wantStatus  int
+		wantAllowed bool // Access-Control-Allow-Origin is the origin
+		wantReached bool
+	}{
+		{name: "preflight from an allowed origin", method: http.MethodOptions, origin: "http://localhost:5173", preflight: true,
+			wantStatus: http.StatusNoContent, wantAllowed: true},
+		{name: "preflight from another origin", method: http.MethodOptions, origin: "https://evil.example", preflight: true,
+			wantStatus: http.StatusForbidden},
+		{name: "preflight without Origin", method: http.MethodOptions, preflight: true,
+			wantStatus: http.StatusForbidden},
+		{name: "OPTIONS that isn't a preflight", method: http.MethodOptions, origin: "http://localhost:5173", token: true,
+			wantStatus: http.StatusOK, wantAllowed: true, wantReached: true},
+		{name: "GET from an allowed origin", method: http.MethodGet, origin: "http://localhost:5173", token: true,
+			wantStatus: http.StatusOK, wantAllowed: true, wantReached: true},
+		{name: "GET from another origin", method: http.MethodGet, origin: "https://evil.example", token: true,
+			wantStatus: http.StatusOK, wantReached: true},
+		{name: "GET from an allowed origin without token", method: http.MethodGet, origin: "http://localhost:5173",
+			wantStatus: http.StatusUnauthorized, wantAllowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			req, err := http.NewRequest(tt.method, srv.URL+"/snapshot", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+				req.Header.Set("Access-Control-Request-Headers", "authorization")
+			}
+			if tt.token {
+				req.Header.Set("Authorization", "Bearer s3cret")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			allowOrigin := resp.Header.Get("Access-Control-Allow-Origin")
+			if allowed := allowOrigin != ""; allowed != tt.wantAllowed || (allowed && allowOrigin != tt.origin) {
+				t.Errorf("Access-Control-Allow-Origin = %q, want it set (%v) to the origin", allowOrigin, tt.wantAllowed)
+			}
+			if got := resp.Header.Get("Vary"); got != "Origin" {
+				t.Errorf("Vary = %q, want Origin", got)
+			}
+			if reached != tt.wantReached {
+				t.Errorf("handler reached = %v, want %v", reached, tt.wantReached)
+			}
+			if tt.preflight && tt.wantStatus == http.StatusNoContent {
+				for header, want := range map[string]string{
+					"Access-Control-Allow-Methods": "GET, OPTIONS",
+					"Access-Control-Allow-Headers": "Authorization",
+					"Access-Control-Max-Age":       "600",
+				} {
+					if got := resp.Header.Get(header); got != want {
+						t.Errorf("%s = %q, want %q", header, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import "time" // For the decimation interval and the flush timer
+
+// --- Per-Client Decimation ---
+// Clients on a slow link (e.g. /ws/lite on a phone) don't need every frame.
+// Instead of dropping frames blindly, the "decimate" stage of the pipeline
+// (see pipeline.go) keeps the newest broadcast about every robot and hands
+// them to the client at most `maxHz` times per second, so every robot stays
+// on screen, just at a lower frame rate. The gateway's own messages (replies,
+// heartbeats, keyframes) aren't broadcasts and are never held back.
+
+// decimator collects messages between two flushes, one per robot.
+// It is guarded by the hub's mutex.
+type decimator struct {
+	interval time.Duration
+
+	// latest holds the newest undelivered message per robot ID.
+	// order keeps the IDs in the order they first arrived since the last flush,
+	// so the output order is stable instead of Go's random map order.
+	latest map[string]Message
+	order  []string
+
+	// lastFlush is when pending messages were last written.
+	lastFlush time.Time
+}
+
+// newDecimator returns a decimator for at most maxHz flushes per second.
+func newDecimator(maxHz float64) *decimator {
+	return &decimator{
+		interval: time.Duration(float64(time.Second) / maxHz),
+		latest:   make(map[string]Message),
+	}
+}
+
+// add stores msg, replacing an undelivered older message about the same robot.
+// Messages without a robot ID all share the "" slot.
+func (d *decimator) add(msg Message) {
+	if _, ok := d.latest[msg.RobotID]; !ok {
+		d.order = append(d.order, msg.RobotID)
+	}
+	d.latest[msg.RobotID] = msg
+}
+
+// wait returns how long the caller should wait before calling take.
+// It is 0 if a flush is due already.
+func (d *decimator) wait() time.Duration {
+	return max(d.interval-time.Since(d.lastFlush), 0)
+}
+
+// take returns the pending messages and starts a new interval.
+func (d *decimator) take() []Message {
+	out := make([]Message, 0, len(d.order))
+	for _, id := range d.order {
+		out = append(out, d.latest[id])
+	}
+	clear(d.latest)
+	d.order = d.order[:0]
+	d.lastFlush = time.Now()
+	return out
+}
+
+// decimate is the "decimate" stage. It holds back msg for a client with a
+// rate, together with the other messages of the interval, and queues them
+// once it is over. Messages that are due right away go out right away.
+// The caller must hold the mutex.
+func (h *Hub) decimate(c *Client, msg Message, _ *stateFields) bool {
+	if c.dec == nil {
+		return true
+	}
+	c.dec.add(msg)
+	// The timer is armed for the first message of an interval, later ones
+	// just replace what is pending.
+	if c.flush != nil {
+		return false
+	}
+	if wait := c.dec.wait(); wait > 0 {
+		c.flushes++
+		flush := c.flushes
+		c.flush = time.AfterFunc(wait, func() { h.flushDecimated(c, flush) })
+		return false
+	}
+	for _, pending := range c.dec.take() {
+		c.queue(pending)
+	}
+	return false
+}
+
+// flushDecimated queues what c's decimator held back when its flush number
+// `flush` fired. A timer that fires for a client that has left since finds it
+// unregistered and does nothing, one that SetMaxHz stopped or replaced while
+// it waited for the mutex finds another number or none.
+func (h *Hub) flushDecimated(c *Client, flush uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if c.flush == nil || c.flushes != flush {
+		return
+	}
+	c.flush = nil
+	if !h.registered(c) || c.dec == nil {
+		return
+	}
+	for _, msg := range c.dec.take() {
+		c.queue(msg)
+	}
+}
+
+// SetMaxHz applies a {"maxHz":N} request of c. The endpoint's rate is an upper
+// bound (a /ws/lite client can slow down but not speed up), 0 returns to it.
+// What the old rate held back is queued first, then the new one applies.
+func (h *Hub) SetMaxHz(c *Client, hz float64) {
+	if hz == 0 || (c.maxHz > 0 && hz > c.maxHz) {
+		hz = c.maxHz
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if c.flush != nil {
+		c.flush.Stop()
+		c.flush = nil
+	}
+	if c.dec != nil && h.registered(c) {
+		for _, msg := range c.dec.take() {
+			c.queue(msg)
+		}
+	}
+	c.dec = nil
+	if hz > 0 {
+		c.dec = newDecimator(hz)
+	}
+}
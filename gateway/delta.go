@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json" // For decoding states and encoding keyframes
+	"slices"        // For sorting robot IDs
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Delta Encoding ---
+// In a large swarm most robots stand still most of the time. With -delta the hub
+// only forwards a robot's state when its pose (x, y, heading) changed since the
+// previous one, so idle robots cost no bandwidth. A changed state is forwarded
+// unchanged, clients that already understand robot states keep working.
+// Because skipped states are gone for good, clients need a way to catch up:
+// a keyframe {"type":"keyframe","robots":[...]} with the latest state of every
+// robot is sent to new clients right away and to everyone every -keyframe-interval.
+// It also repairs robots a client missed because its queue was full.
+
+// deltaTracker remembers the latest state of every robot.
+// It is guarded by the hub's mutex.
+type deltaTracker struct {
+	// poses are the last forwarded poses, compared to decide what changed.
+	poses map[string]pose
+
+	// latest are the newest states with their payloads as they were received,
+	// extra fields (like "shard") included, so a keyframe carries exactly what
+	// the robot last sent and client filters can look at any of its fields.
+	latest map[string]*stateFields
+}
+
+// pose is the part of a RobotState that counts as a change.
+// Timestamp and Seq change with every packet and are deliberately left out.
+type pose struct {
+	x, y, heading float64
+}
+
+func newDeltaTracker() *deltaTracker {
+	return &deltaTracker{
+		poses:  make(map[string]pose),
+		latest: make(map[string]*stateFields),
+	}
+}
+
+// changed records a payload and reports whether it should be forwarded.
+// `state` is what the UDP server decoded from it with -codec, nil for
+// payloads that aren't a robot state: they are always forwarded, they can't
+// be compared.
+func (d *deltaTracker) changed(state *RobotState, data []byte) bool {
+	if state == nil {
+		return true
+	}
+	// Keyframes are JSON, a payload in another wire format (-codec protobuf)
+	// is kept as the JSON of its state instead.
+	if !json.Valid(data) {
+		var err error
+		if data, err = (jsonCodec{}).Encode(*state); err != nil {
+			return true
+		}
+	}
+	d.latest[state.ID] = &stateFields{state: state, payload: data}
+
+	p := pose{x: state.X, y: state.Y, heading: state.Heading}
+	// SYNTAX: structs of comparable fields can be compared with `==`.
+	if prev, ok := d.poses[state.ID]; ok && prev == p {
+		return false
+	}
+	d.poses[state.ID] = p
+	return true
+}
+
+// keyframe is the message listing every robot's latest state, e.g.
+// {"type":"keyframe","robots":[{"id":"r1",...},{"id":"r2",...}]}.
+type keyframe struct {
+	Type   string            `json:"type,omitempty"`
+	Robots []json.RawMessage `json:"robots"`
+}
+
+// keyframe builds a keyframe of the robots `wants` accepts, wrapped in an
+// envelope if `wrap` is set. ok is false if there is no robot to send.
+func (d *deltaTracker) keyframe(wants func(id string, fields *stateFields) bool, wrap bool) (msg Message, ok bool) {
+	// Sorted by ID, so consecutive keyframes are easy to compare.
+	ids := make([]string, 0, len(d.latest))
+	for id, fields := range d.latest {
+		if wants(id, fields) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return Message{}, false
+	}
+	slices.Sort(ids)
+
+	frame := keyframe{Type: typeKeyframe, Robots: make([]json.RawMessage, 0, len(ids))}
+	for _, id := range ids {
+		frame.Robots = append(frame.Robots, d.latest[id].payload)
+	}
+	if wrap {
+		// The envelope carries the type, the payload doesn't repeat it.
+		frame.Type = ""
+	}
+	// Every entry is valid JSON (see `changed`), so this can't fail.
+	data, _ := json.Marshal(frame)
+	if wrap {
+		data = wrapEnvelope(typeKeyframe, data)
+	}
+	return Message{Type: websocket.TextMessage, Data: data}, true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// With -codec protobuf the payloads aren't JSON, delta has to compare the
+// states the codec decoded instead of forwarding everything.
+func TestDeltaComparesDecodedStates(t *testing.T) {
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			d := newDeltaTracker()
+			send := func(x float64) bool {
+				t.Helper()
+				state := RobotState{ID: "robot_1", X: x, Y: 2, Heading: 0.5}
+				data, err := codec.Encode(state)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return d.changed(&state, data)
+			}
+			if !send(1) {
+				t.Error("first state wasn't forwarded")
+			}
+			if send(1) {
+				t.Error("unchanged state was forwarded")
+			}
+			if !send(3) {
+				t.Error("moved robot wasn't forwarded")
+			}
+
+			// Keyframes are JSON whatever the wire format.
+			msg, ok := d.keyframe(func(string, *stateFields) bool { return true }, false)
+			if !ok || !bytes.Contains(msg.Data, []byte(`"id":"robot_1"`)) || !bytes.Contains(msg.Data, []byte(`"x":3`)) {
+				t.Errorf("keyframe = %s, want robot_1 at x 3", msg.Data)
+			}
+		})
+	}
+	if d := newDeltaTracker(); !d.changed(nil, []byte(`{"type":"heartbeat"}`)) {
+		t.Error("payload without a state wasn't forwarded")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors" // For inspecting read errors
+	"net"    // For recognizing timeouts
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Disconnect Reasons ---
+// Every client that goes away is counted in gateway_client_disconnects_total
+// by why it went, so a spike of churn can be told apart: closed tabs are
+// normal, pong timeouts point at the network, write errors at clients that
+// can't keep up, message_too_big at a frontend bug.
+// Whoever ends the connection first (readPump, writePump, CloseAll) records
+// the reason, the ones failing after it because the connection is gone don't count.
+
+// The values of the "reason" label.
+const (
+	reasonNormal         = "normal"          // the client closed with 1000
+	reasonGoingAway      = "going_away"      // the client closed with 1001, e.g. a closed tab
+	reasonClientError    = "client_error"    // the client closed with any other code
+	reasonConnectionLost = "connection_lost" // the connection broke without a close frame
+	reasonPongTimeout    = "pong_timeout"    // no pong within pongWait
+	reasonIdleTimeout    = "idle_timeout"    // no message within -idle-timeout, closed with 1008
+	reasonMessageTooBig  = "message_too_big" // a message over -max-message-size, closed with 1009
+	reasonWriteError     = "write_error"     // writing a message or ping failed or timed out
+	reasonShutdown       = "shutdown"        // the gateway is shutting down
+	reasonReplaced       = "replaced"        // a new session of the same identity took over, see session.go
+	reasonInternalError  = "internal_error"  // serving the client panicked, closed with 1011
+)
+
+// setReason records why the client is going away, unless a reason is already recorded.
+func (c *Client) setReason(reason string) {
+	// SYNTAX: CompareAndSwap only stores the new value if the current one is nil.
+	c.reason.CompareAndSwap(nil, &reason)
+}
+
+// disconnectReason returns the recorded reason, connection_lost if there is none.
+func (c *Client) disconnectReason() string {
+	if reason := c.reason.Load(); reason != nil {
+		return *reason
+	}
+	return reasonConnectionLost
+}
+
+// readFailure classifies the error that ended readPump. Idle timeouts look
+// like pong timeouts here, readPump tells them apart itself.
+func readFailure(err error) string {
+	// SYNTAX: errors.As finds an error of the given type in the chain and stores it.
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr):
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure:
+			return reasonNormal
+		case websocket.CloseGoingAway:
+			return reasonGoingAway
+		case websocket.CloseAbnormalClosure:
+			// gorilla reports a connection that ended mid-frame as 1006, no client sent it.
+			return reasonConnectionLost
+		}
+		return reasonClientError
+	case errors.Is(err, websocket.ErrReadLimit):
+		return reasonMessageTooBig
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return reasonPongTimeout
+	}
+	return reasonConnectionLost
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json" // For reading fields that RobotState doesn't have
+	"fmt"           // For describing invalid filters
+)
+
+// --- Per-Client Filters ---
+// A client can limit the stream to robots whose state matches all of a few
+// comparisons, e.g. only robots that are low on battery:
+//
+//	{"filter":[{"field":"battery","op":"<","value":20}]}
+//
+// Fields are the numbers of a JSON robot state: the RobotState ones (x, y,
+// heading, timestamp, seq) and any other top-level number the simulation sends.
+// A robot without the field doesn't match. An empty list removes the filter.
+// Only messages about a robot are filtered, the gateway's own (heartbeats,
+// keyframes, errors) always pass. The language is deliberately tiny: a few
+// numeric comparisons cost the same whatever a client sends, so a filter can't
+// slow down the broadcast for everyone else.
+
+// maxFilterConditions caps the comparisons of one filter.
+const maxFilterConditions = 8
+
+// condition is one comparison of a filter.
+type condition struct {
+	Field string  `json:"field"`
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+// filter matches a state if all its conditions do.
+type filter []condition
+
+// compileFilter validates the conditions a client sent.
+func compileFilter(conds []condition) (filter, error) {
+	if len(conds) > maxFilterConditions {
+		return nil, fmt.Errorf("%d conditions, at most %d are allowed", len(conds), maxFilterConditions)
+	}
+	for _, c := range conds {
+		switch c.Op {
+		case "<", "<=", ">", ">=", "==", "!=":
+		default:
+			return nil, fmt.Errorf("unknown operator %q", c.Op)
+		}
+		if c.Field == "" {
+			return nil, fmt.Errorf("condition without a field")
+		}
+	}
+	return filter(conds), nil
+}
+
+// matches reports whether the state behind `fields` satisfies every condition.
+func (f filter) matches(fields *stateFields) bool {
+	for _, c := range f {
+		value, ok := fields.get(c.Field)
+		if !ok {
+			return false
+		}
+		var match bool
+		switch c.Op {
+		case "<":
+			match = value < c.Value
+		case "<=":
+			match = value <= c.Value
+		case ">":
+			match = value > c.Value
+		case ">=":
+			match = value >= c.Value
+		case "==":
+			match = value == c.Value
+		case "!=":
+			match = value != c.Value
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// stateFields looks up the numeric fields of one message for the filters of
+// all clients. The payload is only parsed if a filter asks for a field that
+// RobotState doesn't have, and then at most once per message.
+// It is not safe for concurrent use.
+type stateFields struct {
+	state   *RobotState
+	payload []byte
+
+	parsed bool
+	extra  map[string]float64
+}
+
+// get returns the field called `name`, false if the state has no such number.
+func (f *stateFields) get(name string) (float64, bool) {
+	switch name {
+	case "x":
+		return f.state.X, true
+	case "y":
+		return f.state.Y, true
+	case "heading":
+		return f.state.Heading, true
+	case "timestamp":
+		return float64(f.state.Timestamp), true
+	case "seq":
+		if f.state.Seq == nil {
+			return 0, false
+		}
+		return float64(*f.state.Seq), true
+	}
+	if !f.parsed {
+		f.parsed = true
+		// Binary payloads (e.g. protobuf) don't parse and only have the fields above.
+		var fields map[string]any
+		if json.Unmarshal(f.payload, &fields) == nil {
+			f.extra = make(map[string]float64, len(fields))
+			for k, v := range fields {
+				if n, ok := v.(float64); ok {
+					f.extra[k] = n
+				}
+			}
+		}
+	}
+	value, ok := f.extra[name]
+	return value, ok
+}
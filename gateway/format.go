@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync" // For encoding each format once
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Per-Client Frame Format ---
+// Browsers prefer JSON text, native tools the compact binary encoding. A client
+// picks its format with {"format":"text"} or {"format":"binary"}, whatever
+// the simulation sends and -codec/-to-json/-binary make of it:
+//
+//	text    robot states as JSON in text frames
+//	binary  robot states as protobuf (robotpb.RobotState) in binary frames
+//
+// Without a request frames go out as the gateway produces them, which is JSON
+// text for the default setup. Only robot states that the gateway decoded are
+// re-encoded, its own messages (heartbeats, keyframes, errors) and packets that
+// didn't decode are sent unchanged.
+//
+// A dashboard asking for text and a native app asking for binary can be
+// connected at the same time. Each broadcast is encoded at most once per format,
+// however many clients want it: the first writePump that needs a format
+// encodes it, the others reuse the bytes (see encodings).
+// gateway_frames_reencoded_total counts the encodings.
+
+// frameFormat is a client's choice, stored in Client.format.
+type frameFormat int32
+
+const (
+	formatAsIs frameFormat = iota
+	formatText
+	formatBinary
+)
+
+// parseFrameFormat returns the format called `name`.
+func parseFrameFormat(name string) (frameFormat, bool) {
+	switch name {
+	case "text":
+		return formatText, true
+	case "binary":
+		return formatBinary, true
+	}
+	return formatAsIs, false
+}
+
+// encodings holds a broadcast's re-encoded frames. Hub.deliver gives every
+// broadcast state one, and all copies of the Message (one per client queue, the
+// cached last message, the history) share it.
+type encodings struct {
+	text, binary encoded
+}
+
+// encoded is one format's frame, filled in by the first client that needs it.
+type encoded struct {
+	// SYNTAX: sync.Once runs its function exactly once, concurrent callers wait for it to finish.
+	once    sync.Once
+	msgType int
+	data    []byte
+}
+
+// reformat returns msg in format f. JSON states are wrapped in an envelope if `wrap` is set,
+// like the hub does for states that are text from the start.
+// `wrap` is the hub's -envelope, the same for every client, so the frames can be shared.
+func reformat(msg Message, f frameFormat, wrap bool) Message {
+	if msg.State == nil {
+		return msg
+	}
+	var slot *encoded
+	switch {
+	case msg.encodings == nil:
+		// Not from a broadcast (e.g. a sampled out message as the snapshot).
+		return encode(msg, f, wrap)
+	case f == formatText:
+		slot = &msg.encodings.text
+	case f == formatBinary:
+		slot = &msg.encodings.binary
+	default:
+		return msg
+	}
+	slot.once.Do(func() {
+		encoded := encode(msg, f, wrap)
+		slot.msgType, slot.data = encoded.Type, encoded.Data
+	})
+	msg.Type, msg.Data = slot.msgType, slot.data
+	return msg
+}
+
+// encode does reformat's work, without the cache.
+func encode(msg Message, f frameFormat, wrap bool) Message {
+	switch {
+	case f == formatText && msg.Type == websocket.BinaryMessage:
+		data, err := (jsonCodec{}).Encode(*msg.State)
+		if err != nil {
+			return msg
+		}
+		if wrap {
+			data = wrapState(data, msg.Seq)
+		}
+		framesReencoded.WithLabelValues("text").Inc()
+		msg.Type, msg.Data = websocket.TextMessage, data
+	case f == formatBinary:
+		// Binary frames may still carry JSON (e.g. with -binary), always encode.
+		data, err := (protobufCodec{}).Encode(*msg.State)
+		if err != nil {
+			return msg
+		}
+		framesReencoded.WithLabelValues("binary").Inc()
+		msg.Type, msg.Data = websocket.BinaryMessage, data
+	}
+	return msg
+}
+
+// --- Subprotocols ---
+// A frontend can also name the format it speaks in the handshake, as a
+// WebSocket subprotocol (`new WebSocket(url, ["robots.v2", "robots.v1"])`).
+// The gateway picks the first of its own list that the client offers,
+// newer versions first, and starts the client in that version's format:
+//
+//	robots.v2  binary, robot states as protobuf
+//	robots.v1  text, robot states as JSON
+//
+// A {"format":...} message can still switch it later. Clients that don't ask
+// for a subprotocol get frames as before. A client offering only versions we
+// don't know wouldn't understand our frames, it is refused with a close frame
+// saying which versions are supported.
+
+// subprotocols maps the supported subprotocols to their format, in order of preference.
+var subprotocols = []struct {
+	name   string
+	format frameFormat
+}{
+	{"robots.v2", formatBinary},
+	{"robots.v1", formatText},
+}
+
+// subprotocolNames returns the names for websocket.Upgrader.Subprotocols.
+func subprotocolNames() []string {
+	names := make([]string, len(subprotocols))
+	for i, p := range subprotocols {
+		names[i] = p.name
+	}
+	return names
+}
+
+// subprotocolFormat returns the format of the negotiated subprotocol, formatAsIs for none.
+func subprotocolFormat(name string) frameFormat {
+	for _, p := range subprotocols {
+		if p.name == name {
+			return p.format
+		}
+	}
+	return formatAsIs
+}
+
+// offersKnownSubprotocol reports whether a client that asked for subprotocols
+// (websocket.Subprotocols(r)) offered at least one we support. Clients that
+// asked for none are fine too.
+func offersKnownSubprotocol(offered []string) bool {
+	if len(offered) == 0 {
+		return true
+	}
+	for _, name := range offered {
+		if subprotocolFormat(name) != formatAsIs {
+			return true
+		}
+	}
+	return false
+}
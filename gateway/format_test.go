@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// A protobuf state re-encoded for a JSON client is wrapped like the states
+// that were JSON from the start, with their "seq", or reconnecting with
+// ?since= wouldn't work for that client.
+func TestReformatKeepsTheSeqOfTheEnvelope(t *testing.T) {
+	state := benchState
+	data, err := (protobufCodec{}).Encode(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{Type: websocket.BinaryMessage, Data: data, State: &state, RobotID: state.ID, Seq: 42}
+
+	got := reformat(msg, formatText, true)
+	if got.Type != websocket.TextMessage {
+		t.Fatalf("frame type = %d, want text", got.Type)
+	}
+	var env envelope
+	if err := json.Unmarshal(got.Data, &env); err != nil {
+		t.Fatalf("reformatted frame %s: %v", got.Data, err)
+	}
+	if env.Type != typeState || env.Seq != msg.Seq {
+		t.Errorf("envelope type %q seq %d, want %q seq %d", env.Type, env.Seq, typeState, msg.Seq)
+	}
+	var payload RobotState
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != state.ID || payload.X != state.X {
+		t.Errorf("payload = %+v, want %+v", payload, state)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog" // For structured logging
+	"math"     // For moving the robots in circles
+	"net"      // For the UDP socket
+	"strconv"  // For robot names
+	"time"     // For pacing and timestamps
+)
+
+// GenOptions configures runGenerator.
+type GenOptions struct {
+	// Target is the UDP address packets are sent to, normally a gateway's -udp-addr.
+	Target string
+	// Robots is how many robots are simulated, every robot gets one packet per tick.
+	Robots int
+	// Hz is the number of ticks per second.
+	Hz float64
+	// Codec encodes the packets, it should match the receiving gateway's -codec.
+	Codec Codec
+}
+
+// runGenerator pretends to be the simulation: it sends synthetic RobotState
+// packets to opts.Target until the process is stopped. Each robot drives in
+// its own circle, so the frontend has something moving to show.
+// It is started with `go run . -gen` and lets you exercise a gateway end to end
+// without building the Rust simulation.
+func runGenerator(opts GenOptions) error {
+	conn, err := net.Dial("udp", opts.Target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	slog.Info("generating robot states", "target", opts.Target, "robots", opts.Robots, "hz", opts.Hz)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Hz))
+	defer ticker.Stop()
+
+	start := time.Now()
+	var seq uint32
+	for now := range ticker.C {
+		t := now.Sub(start).Seconds()
+		for i := range opts.Robots {
+			// Spread the robots over different radii and phases.
+			radius := 1 + float64(i)
+			angle := t + float64(i)
+			state := RobotState{
+				ID:        robotName(i),
+				X:         radius * math.Cos(angle),
+				Y:         radius * math.Sin(angle),
+				Heading:   math.Mod(angle+math.Pi/2, 2*math.Pi),
+				Timestamp: now.UnixMilli(),
+				Seq:       &seq,
+			}
+			packet, err := opts.Codec.Encode(state)
+			if err != nil {
+				return err
+			}
+			// Nobody listening is not fatal for a test tool, the target may start later.
+			if _, err := conn.Write(packet); err != nil {
+				slog.Debug("sending generated packet failed", "err", err)
+			}
+			seq++
+		}
+	}
+	return nil
+}
+
+// robotName returns the ID of the i-th generated robot, matching the simulation's "robot_1" style.
+func robotName(i int) string {
+	return "robot_" + strconv.Itoa(i+1)
+}
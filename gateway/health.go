@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"    // For the probe handlers
+	"sync/atomic" // For the lock-free readiness flag
+)
+
+// --- Liveness and Readiness Probes ---
+// Kubernetes (or any orchestrator) polls these to decide whether to restart
+// the container (liveness) and whether to route traffic to it (readiness).
+
+// sourcesRunning counts the data sources (UDP read loops, or a replay) that are running.
+// Each startUDPServer increments it once its socket is bound and its read loop runs.
+// Until then the gateway can accept WebSocket clients but has nothing to send them.
+var sourcesRunning atomic.Int32
+
+// handleHealthz always answers 200: if the process can serve HTTP, it is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers 200 only once a UDP listener is up, 503 before that.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if sourcesRunning.Load() == 0 {
+		http.Error(w, "udp listener not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready\n"))
+}
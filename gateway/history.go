@@ -0,0 +1,113 @@
+package main
+
+import (
+	"cmp"    // For ordering by sequence number
+	"math"   // For an unlimited replay
+	"slices" // For merging the per-robot histories
+	"time"   // For expiring old entries
+)
+
+// --- Message History ---
+// A frontend reload takes a second or two. With -history the hub keeps the
+// last few messages of every robot and replays them to new clients, so trails
+// and charts continue where they left off instead of starting empty.
+// A client that reconnects with the number of the last message it saw gets
+// only what it missed, as long as the history still has all of it (see since).
+
+// history keeps the newest `size` messages per robot ID. It is guarded by the hub's mutex.
+type history struct {
+	size   int
+	maxAge time.Duration
+	rings  map[string]*ring
+	// evicted is the highest Message.Seq that was dropped (overwritten or
+	// expired). A client that saw everything up to it can still resume.
+	evicted uint64
+}
+
+// ring is a fixed size circular buffer, once full every add overwrites the oldest message.
+type ring struct {
+	msgs []Message
+	// next is the index the next message is written to.
+	next int
+}
+
+// newHistory returns a history of `size` messages per robot that forgets
+// messages older than maxAge (0 = never).
+func newHistory(size int, maxAge time.Duration) *history {
+	return &history{size: size, maxAge: maxAge, rings: make(map[string]*ring)}
+}
+
+// add appends msg to the history of its robot.
+func (h *history) add(msg Message) {
+	r := h.rings[msg.RobotID]
+	if r == nil {
+		r = &ring{msgs: make([]Message, 0, h.size)}
+		h.rings[msg.RobotID] = r
+	}
+	if len(r.msgs) < h.size {
+		r.msgs = append(r.msgs, msg)
+		return
+	}
+	h.evicted = max(h.evicted, r.msgs[r.next].Seq)
+	r.msgs[r.next] = msg
+	r.next = (r.next + 1) % h.size
+}
+
+// replay returns up to `limit` of the newest messages of all robots, oldest
+// first, the order they were originally broadcast in. Robots whose messages
+// have all expired are forgotten, so robots that went away don't use memory forever.
+func (h *history) replay(limit int) []Message {
+	var cutoff time.Time
+	if h.maxAge > 0 {
+		cutoff = time.Now().Add(-h.maxAge)
+	}
+
+	var out []Message
+	for id, r := range h.rings {
+		kept := 0
+		for _, msg := range r.msgs {
+			if msg.Received.Before(cutoff) {
+				h.evicted = max(h.evicted, msg.Seq)
+				continue
+			}
+			out = append(out, msg)
+			kept++
+		}
+		// SYNTAX: deleting from a map while ranging over it is allowed in Go.
+		if kept == 0 {
+			delete(h.rings, id)
+		}
+	}
+
+	slices.SortStableFunc(out, func(a, b Message) int {
+		return a.Received.Compare(b.Received)
+	})
+	if len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// since returns the messages broadcast after the one numbered `seq`, in order,
+// for a client resuming its stream. It returns false if some of them are no
+// longer kept or there are more than `limit`, the client needs a full snapshot then.
+func (h *history) since(seq uint64, limit int) ([]Message, bool) {
+	// Replaying first forgets expired messages, so `evicted` is up to date.
+	all := h.replay(math.MaxInt)
+	if seq < h.evicted {
+		return nil, false
+	}
+	var out []Message
+	for _, msg := range all {
+		if msg.Seq > seq {
+			out = append(out, msg)
+		}
+	}
+	if len(out) > limit {
+		return nil, false
+	}
+	slices.SortFunc(out, func(a, b Message) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	return out, true
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"       // For stopping Run
+	"fmt"           // For describing a worker's panic
+	"log/slog"      // For logging dropped messages
+	"runtime/debug" // For a worker's stack
+	"slices"        // For looking up pipeline stages
+	"sync"          // Provides synchronization primitives, like mutexes
+	"sync/atomic"   // For the sequence number
+	"time"          // For write deadlines
+
+	"github.com/gorilla/websocket"
+)
+
+// Message is one frame on its way from the simulation to the clients.
+type Message struct {
+	// Type is websocket.TextMessage or websocket.BinaryMessage.
+	Type int
+	Data []byte
+
+	// RobotID is the robot the message is about, "" if it isn't a robot state.
+	// It is decoded once by the data source so the hub and every client can use it for free.
+	RobotID string
+
+	// Received is when the data source got the packet, zero for messages the
+	// gateway makes up itself (heartbeats, keyframes). Used for latency metrics.
+	Received time.Time
+
+	// State is the decoded robot state, nil if the message isn't one (or didn't
+	// decode). Clients that asked for a different format are sent it re-encoded, see format.go.
+	State *RobotState
+
+	// Seq numbers the broadcasts of a hub, starting at 1, so a client that
+	// reconnects can say where it left off (see Client.since). 0 for the
+	// gateway's own messages.
+	Seq uint64
+
+	// Room is the room the message is broadcast to, see room.go.
+	Room string
+
+	// CacheOnly makes the hub only keep the message as its room's last message
+	// instead of broadcasting it, for packets left out by UDPOptions.Sample.
+	CacheOnly bool
+
+	// encodings caches the message in other formats, see format.go. nil
+	// outside of broadcasts, reformat encodes for every client then.
+	encodings *encodings
+}
+
+// Hub keeps track of the connected WebSocket clients and fans out every
+// message it receives to the clients in the message's room (see room.go).
+// Keeping this state in a struct (instead of package globals) lets us run
+// several independent hubs in one process, e.g. in tests.
+type Hub struct {
+	// rooms stores all active clients, by room name. Each room keeps its clients
+	// in a map, with pointers to Client objects as keys, for efficient addition
+	// and removal. A room also caches its last message (sent to new clients right
+	// away, so they don't stare at an empty screen until the next packet), and
+	// its history, dedup and delta state.
+	rooms map[string]*room
+
+	// count is the number of registered clients in all rooms, for MaxClients.
+	count int
+
+	// sessions is the client of every identity with SingleSession, see session.go.
+	sessions map[string]*Client
+
+	// named counts the fed rooms that aren't in HubOptions.Rooms, for MaxRooms.
+	named int
+
+	// mutex is a "mutual exclusion lock". It guards `rooms`, `count`, `sessions` and `named`,
+	// which are touched by Run as well as by every connection handler goroutine.
+	mutex sync.Mutex
+
+	// broadcast is a channel that acts as a queue for messages received from the simulation.
+	// Messages sent to this channel will be forwarded to all connected clients by Run.
+	broadcast chan Message
+
+	// seq is the Seq of the newest message, see Message.Seq. Written by Run,
+	// read by Register.
+	seq atomic.Uint64
+
+	// rate measures the broadcasts per second, for the metrics and "/stats".
+	rate rateMeter
+
+	// ingestPaused holds back incoming messages, see ingest.go.
+	ingestPaused atomic.Bool
+
+	// targets is fanOut's reusable list of clients.
+	targets []*Client
+
+	// perClient are the per-client stages of the pipeline, see pipeline.go.
+	// filtering is set if "filter" is one of them.
+	perClient clientPipeline
+	filtering bool
+
+	opts HubOptions
+}
+
+// HubOptions configures a Hub.
+type HubOptions struct {
+	// MaxClients caps the number of registered clients. 0 means no limit.
+	MaxClients int
+
+	// CacheLast makes the hub remember the last message and replay it to every
+	// newly registered client. Turn it off for streams where old frames are meaningless.
+	CacheLast bool
+
+	// QueueSize is the capacity of the broadcast queue between the data sources
+	// and Run. When it is full, new messages are dropped (and counted) instead of
+	// blocking the UDP reader, which would make the kernel drop packets invisibly.
+	QueueSize int
+
+	// DropOldest decides what a lagging client loses when its send queue is
+	// full (see Client.queue). Off, the new message is dropped: the client sees
+	// every message it gets in order, but after a stall it works through stale
+	// ones first and the newest state may be the one that is missing. On, the
+	// oldest queued message makes room: the client always ends up with the
+	// freshest data, which suits telemetry, but the gaps are in the middle of
+	// the stream and may hit any frame (a snapshot, an ack). Both count as dropped.
+	DropOldest bool
+
+	// QueueRetry lets a message wait up to this long for room in a full queue
+	// before it is dropped. A few milliseconds absorb a micro-burst at the cost
+	// of briefly holding up the UDP reader, which the socket's receive buffer
+	// covers. 0 drops right away.
+	QueueRetry time.Duration
+
+	// Heartbeat makes Run send a heartbeat message (see protocol.go) to every client
+	// after this long without a broadcast, so frontends can tell a quiet simulation
+	// from a dead connection. 0 disables heartbeats.
+	Heartbeat time.Duration
+
+	// Envelope wraps every message as {"type":...,"payload":...} before it is
+	// delivered, see protocol.go.
+	Envelope bool
+
+	// Dedup skips broadcasting a message whose payload is identical to the previous
+	// one about the same robot, e.g. a paused simulation retransmitting its state.
+	// The last-message cache keeps the previous copy, which has the same payload.
+	Dedup bool
+
+	// Delta only forwards robot states whose pose changed and sends keyframes
+	// with every robot's state to new clients and every KeyframeInterval
+	// (0 = only to new clients), see delta.go.
+	Delta            bool
+	KeyframeInterval time.Duration
+
+	// History keeps the last History messages of every robot and replays them
+	// to new clients, messages older than HistoryMaxAge (0 = any age) are left out.
+	// 0 disables the history, see history.go.
+	History       int
+	HistoryMaxAge time.Duration
+
+	// Workers spreads the delivery of every message over up to this many
+	// goroutines once there are thousands of clients, so the mutex is held for
+	// a shorter time on multi-core machines. 0 or 1 delivers from Run's goroutine.
+	Workers int
+
+	// RequireHello holds back broadcasts from a new client until it has answered
+	// the hello frame queued by Register (see protocol.go) with {"hello":true},
+	// instead of sending to a page that isn't listening yet. Otherwise clients
+	// receive broadcasts as soon as they are registered.
+	RequireHello bool
+
+	// Untracked keeps the hub's broadcasts out of the gateway-wide broadcast
+	// metrics and its clients out of the client metrics and "/stats", for a
+	// hub that only mirrors another one's input (see tap.go).
+	Untracked bool
+
+	// SingleSession allows one client per identity (Client.identity): "off",
+	// "reject" to turn a second one away or "replace" to close the first one,
+	// see session.go. "" is "off".
+	SingleSession string
+
+	// Pipeline is the order in which the Dedup, Delta and Envelope stages run,
+	// see pipeline.go. nil means defaultPipeline.
+	Pipeline []string
+
+	// MaxRooms caps the rooms that messages can create by naming them, see
+	// room.go. The default room and Rooms, the ones of the -udp-addr entries,
+	// don't count. 0 means no limit.
+	MaxRooms int
+	Rooms    []string
+}
+
+// NewHub creates an empty hub. Call Run in its own goroutine to start delivering messages.
+func NewHub(opts HubOptions) *Hub {
+	if opts.Pipeline == nil {
+		// The default is known to parse.
+		opts.Pipeline, _ = parsePipeline(defaultPipeline)
+	}
+	h := &Hub{
+		// SYNTAX: `make(map[keyType]valueType)` creates a map, `make(chan dataType)` creates a channel.
+		rooms:     make(map[string]*room),
+		sessions:  make(map[string]*Client),
+		broadcast: make(chan Message, opts.QueueSize),
+		opts:      opts,
+		filtering: slices.Contains(opts.Pipeline, "filter"),
+	}
+	h.perClient = h.newClientPipeline()
+	return h
+}
+
+// Count returns the number of currently registered clients.
+func (h *Hub) Count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+// Clients returns the currently registered clients, in no particular order.
+func (h *Hub) Clients() []*Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	clients := make([]*Client, 0, h.count)
+	for _, r := range h.rooms {
+		for client := range r.clients {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Full reports whether the hub has reached its client limit.
+// It is only a hint for rejecting early, Register makes the final decision.
+func (h *Hub) Full() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.full()
+}
+
+// full is Full for callers that already hold the mutex.
+func (h *Hub) full() bool {
+	return h.opts.MaxClients > 0 && h.count >= h.opts.MaxClients
+}
+
+// Rate returns how many messages per second were broadcast, averaged over the
+// last few seconds (see rate.go). Messages skipped by Dedup or Delta don't count.
+func (h *Hub) Rate() float64 {
+	return h.rate.rate()
+}
+
+// Last returns the cached last message of a room, or nil if there is none (yet).
+func (h *Hub) Last(name string) *Message {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if r := h.rooms[name]; r != nil {
+		return r.last
+	}
+	return nil
+}
+
+// Register adds a client to its room (Client.room) so it receives the room's
+// future broadcasts. If a last message is cached (or a history kept), it is
+// queued for the client first, so the client starts with a snapshot. A client resuming a stream (see Client.since) gets
+// just the messages it missed instead, if the history still has all of them.
+// With RequireHello a hello frame goes first and the client only becomes
+// ready for broadcasts once it answers.
+// It returns errHubFull when the hub is full and errSessionActive when
+// SingleSession turns c away, and does not add the client then. A client c
+// replaces is returned, the caller must displace it.
+func (h *Hub) Register(c *Client) (displaced *Client, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Before the limit: a replaced client frees its slot.
+	displaced, err = h.claimSession(c)
+	if err != nil {
+		return nil, err
+	}
+	if h.full() {
+		h.endSession(c)
+		return displaced, errHubFull
+	}
+	// Set before writePump starts, which is the only reader.
+	c.envelope = h.opts.Envelope
+	c.dropOldest = h.opts.DropOldest
+	if c.maxHz > 0 {
+		c.dec = newDecimator(c.maxHz)
+	}
+	// Queueing the snapshot under the same lock that Run uses guarantees it
+	// arrives before any newer broadcast. The queue is empty, so this can't block.
+	// The history already ends with the last message. It is capped at the size
+	// of the queue, a longer one couldn't be queued without blocking.
+	room := cap(c.send) - 1
+	if h.opts.RequireHello {
+		c.send <- helloMessage(c.id, h.opts.Envelope)
+		room--
+	} else {
+		c.ready.Store(true)
+	}
+	r := h.room(c.room)
+	r.clients[c] = true
+	h.count++
+	// A `since` ahead of our numbering is from before a restart of the gateway.
+	if c.since > 0 && r.history != nil && c.since <= h.seq.Load() {
+		if msgs, ok := r.history.since(c.since, room+1); ok {
+			for _, msg := range msgs {
+				c.send <- msg
+			}
+			c.resumed = true
+			return displaced, nil
+		}
+	}
+	h.snapshot(c, r, room)
+	return displaced, nil
+}
+
+// snapshot queues the current state of room r for c: its history or last
+// message, or a keyframe in delta mode. It queues at most room+1 messages,
+// the caller must make sure they fit. The caller must hold the mutex.
+func (h *Hub) snapshot(c *Client, r *room, room int) {
+	if r.history != nil {
+		for _, msg := range r.history.replay(room) {
+			c.send <- msg
+		}
+	}
+	// In delta mode the snapshot is a keyframe, the last message alone could be
+	// about any robot and the others might not be sent again for a long time.
+	// The one slot left free above is for it.
+	if r.delta != nil {
+		if msg, ok := r.delta.keyframe(h.keyframeFilter(c), h.opts.Envelope); ok {
+			c.send <- msg
+		}
+	} else if r.last != nil && r.history == nil {
+		c.send <- *r.last
+	}
+}
+
+// Lookup returns the registered client with the given id, nil if there is none.
+func (h *Hub) Lookup(id uint64) *Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// A linear scan is fine for the occasional operator request, Run never needs it.
+	for _, r := range h.rooms {
+		for client := range r.clients {
+			if client.id == id {
+				return client
+			}
+		}
+	}
+	return nil
+}
+
+// Send queues msg for client c alone, e.g. the reply to one of its commands.
+// It returns false if c isn't registered (anymore) or its queue is full.
+func (h *Hub) Send(c *Client, msg Message) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// After Unregister or CloseAll `send` is closed, sending to it would panic.
+	if !h.registered(c) {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		c.dropped.Add(1)
+		return false
+	}
+}
+
+// Pause stops (paused = true) or resumes broadcasts to c, which stays
+// registered and connected. A resumed client gets its room's snapshot first,
+// like a new one (see Register), in as much space as its queue has left, so
+// it doesn't have to wait for the next packet to be up to date again.
+// It returns false if nothing changed, c isn't registered or was already in that state.
+func (h *Hub) Pause(c *Client, paused bool) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.registered(c) || c.paused.Swap(paused) == paused {
+		return false
+	}
+	// Only Run (under this lock) adds to the queue, so this much room can't shrink.
+	if space := cap(c.send) - len(c.send); !paused && c.ready.Load() && space > 0 {
+		h.snapshot(c, h.rooms[c.room], space-1)
+	}
+	return true
+}
+
+// Unregister removes a client and closes its send queue, which stops its writePump.
+// It is safe to call for a client that has already been removed.
+func (h *Hub) Unregister(c *Client) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Only the call that actually removes the client may close `send`,
+	// closing a channel twice panics.
+	if !h.registered(c) {
+		return
+	}
+	h.leave(c)
+	h.endSession(c)
+	h.count--
+	close(c.send)
+}
+
+// Broadcast queues a message for delivery to every registered client.
+// If the queue is full, it waits at most QueueRetry for Run to make room.
+// When there still isn't any, the message is dropped and false is returned.
+func (h *Hub) Broadcast(msg Message) bool {
+	select {
+	case h.broadcast <- msg:
+		return true
+	default:
+	}
+	if h.opts.QueueRetry > 0 {
+		// Only reached with a full queue, so the timer isn't allocated per message.
+		timer := time.NewTimer(h.opts.QueueRetry)
+		defer timer.Stop()
+		select {
+		case h.broadcast <- msg:
+			broadcastQueueAbsorbed.Inc()
+			return true
+		case <-timer.C:
+		}
+	}
+	if !h.opts.Untracked {
+		broadcastQueueDropped.Inc()
+	}
+	return false
+}
+
+// QueueLen returns how many messages are waiting for Run.
+func (h *Hub) QueueLen() int {
+	return len(h.broadcast)
+}
+
+// Run delivers queued messages to all clients. It loops until ctx is canceled
+// or the broadcast channel is closed, so it is meant to be started with `go hub.Run(ctx)`.
+func (h *Hub) Run(ctx context.Context) {
+	// Optional timers. A nil channel is never ready, so the select below simply
+	// ignores the ones that are disabled.
+	var heartbeatTimer *time.Timer
+	var heartbeat <-chan time.Time
+	if h.opts.Heartbeat > 0 {
+		// The timer only fires after a full Heartbeat period without a broadcast,
+		// every delivered message pushes it back.
+		heartbeatTimer = time.NewTimer(h.opts.Heartbeat)
+		defer heartbeatTimer.Stop()
+		heartbeat = heartbeatTimer.C
+	}
+	var keyframes <-chan time.Time
+	if h.opts.Delta && h.opts.KeyframeInterval > 0 {
+		ticker := time.NewTicker(h.opts.KeyframeInterval)
+		defer ticker.Stop()
+		keyframes = ticker.C
+	}
+
+	for {
+		select {
+		// This case waits for a message to arrive on the `broadcast` channel.
+		// When a message is received, it's assigned to `msg` and the case body executes.
+		case msg, ok := <-h.broadcast:
+			if !ok {
+				return
+			}
+			// A skipped message didn't reach anyone, so it doesn't count as data.
+			if h.deliver(msg) && heartbeatTimer != nil {
+				// SYNTAX: since Go 1.23 Reset also discards a pending, unreceived expiry.
+				heartbeatTimer.Reset(h.opts.Heartbeat)
+			}
+		case <-heartbeat:
+			h.heartbeat()
+			heartbeatTimer.Reset(h.opts.Heartbeat)
+		case <-keyframes:
+			h.keyframe()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver runs one message through the pipeline of its room and hands the
+// result to every interested client in the room. It returns false if the
+// pipeline dropped the message (e.g. Dedup or Delta) or ingest is paused instead.
+func (h *Hub) deliver(msg Message) bool {
+	// Before anything else, so a paused room keeps its cache, history and dedup/delta state.
+	if h.ingestPaused.Load() {
+		messagesPaused.Inc()
+		return false
+	}
+
+	// Skipped messages use up a number too, that's harmless: clients only
+	// need the numbers to grow, not to be contiguous. Rooms share the
+	// numbering, a client just sees bigger gaps.
+	msg.Seq = h.seq.Add(1)
+
+	// The pipeline rewrites msg.Data, keep the payload as it was received.
+	raw := msg
+
+	// Lock the mutex before touching the rooms map and the room's clients.
+	h.mutex.Lock()
+	// Unlock the mutex after we're done with the room.
+	defer h.mutex.Unlock()
+	if !h.admitRoom(msg.Room) {
+		messagesRoomLimit.Inc()
+		slog.Debug("message for a new room dropped, -max-rooms reached", "room", msg.Room, "max_rooms", h.opts.MaxRooms)
+		return false
+	}
+	r := h.room(msg.Room)
+	r.fed = true
+
+	// A left out message doesn't go through the pipeline: dedup and delta
+	// would take it for sent and hold back the next message like it.
+	if msg.CacheOnly {
+		if h.opts.CacheLast {
+			if h.opts.Envelope && msg.Type == websocket.TextMessage {
+				msg.Data = wrapState(msg.Data, msg.Seq)
+			}
+			r.last = &msg
+		}
+		messagesSampledOut.Inc()
+		return false
+	}
+
+	r.current = &msg
+	data, keep := r.pipeline.run(msg.Data)
+	r.current = nil
+	if !keep {
+		return false
+	}
+	msg.Data = data
+	// After the pipeline, the message doesn't change anymore from here on.
+	if msg.State != nil {
+		msg.encodings = &encodings{}
+	}
+
+	// Update the cache under the same lock, so Register sees either the
+	// old message and this broadcast, or the new message and not this broadcast.
+	// It is cached after the pipeline, so new clients get the snapshot in the same shape.
+	if h.opts.CacheLast {
+		r.last = &msg
+	}
+	if r.history != nil {
+		r.history.add(msg)
+	}
+
+	// Hand the message to every client's own queue, after the per-client
+	// stages. This never blocks: the actual network write happens in the
+	// client's writePump. Filters look at the state before it was wrapped in an envelope.
+	fields := &stateFields{state: raw.State, payload: raw.Data}
+	if shards := h.shards(r); shards > 1 {
+		h.fanOut(msg, fields, r, shards)
+	} else {
+		for client := range r.clients {
+			if h.perClient.run(client, msg, fields) {
+				client.queue(msg)
+			}
+		}
+	}
+	if !h.opts.Untracked {
+		messagesBroadcast.Inc()
+	}
+	h.rate.add()
+	return true
+}
+
+// minShardSize is the smallest number of clients worth handing to a worker
+// goroutine of their own, below that starting it costs more than it saves.
+const minShardSize = 256
+
+// shards returns how many goroutines deliver should spread the clients of r over.
+// The caller must hold the mutex.
+func (h *Hub) shards(r *room) int {
+	return min(h.opts.Workers, len(r.clients)/minShardSize)
+}
+
+// fanOut queues msg for the interested clients of r using `shards` goroutines,
+// each handling its own slice of clients. It returns once all of them are done,
+// so messages still reach every client in order. The caller must hold the mutex,
+// which keeps Unregister from closing a queue while a worker sends to it.
+// The per-client stages run while collecting the targets, `fields` isn't safe for concurrent use.
+func (h *Hub) fanOut(msg Message, fields *stateFields, r *room, shards int) {
+	// Map iteration can't be split, so collect the targets first. The slice is
+	// kept between calls, only Run's goroutine uses it.
+	h.targets = h.targets[:0]
+	for client := range r.clients {
+		if h.perClient.run(client, msg, fields) {
+			h.targets = append(h.targets, client)
+		}
+	}
+
+	// supervise only sees panics on Run's goroutine, one in a worker would end
+	// the process. So a worker hands its panic over, and it is raised again
+	// below, once every worker is done: logged, counted and restarted (or,
+	// with -recover-panics=false, crashing) like any other broadcaster panic.
+	var failed atomic.Pointer[workerPanic]
+	var wg sync.WaitGroup
+	for i := range shards {
+		part := h.targets[i*len(h.targets)/shards : (i+1)*len(h.targets)/shards]
+		wg.Go(func() {
+			defer func() {
+				if v := recover(); v != nil {
+					failed.CompareAndSwap(nil, &workerPanic{value: v, stack: debug.Stack()})
+				}
+			}()
+			for _, client := range part {
+				client.queue(msg)
+			}
+		})
+	}
+	wg.Wait()
+	if p := failed.Load(); p != nil {
+		panic(p)
+	}
+}
+
+// workerPanic is a panic recovered in a fanOut worker, raised again on Run's goroutine.
+type workerPanic struct {
+	value any
+	// stack is the worker's, the one supervise logs is of the goroutine raising it again.
+	stack []byte
+}
+
+// String is what supervise logs as the panic.
+func (p *workerPanic) String() string {
+	return fmt.Sprintf("broadcast worker: %v\n%s", p.value, p.stack)
+}
+
+// heartbeat sends a heartbeat message to every client.
+func (h *Hub) heartbeat() {
+	h.SendAll(heartbeatMessage(time.Now(), h.opts.Envelope))
+}
+
+// SendAll queues a message the gateway made up itself (heartbeat, error) for
+// every client, whatever its subscription or room. Unlike Broadcast it doesn't go
+// through Run: the message isn't cached as the last message, isn't kept in the
+// history and isn't counted as a broadcast.
+func (h *Hub) SendAll(msg Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, r := range h.rooms {
+		for client := range r.clients {
+			client.queue(msg)
+		}
+	}
+}
+
+// keyframe sends every client a keyframe of the robots in its room that it is
+// subscribed to and that pass its filter.
+func (h *Hub) keyframe() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, r := range h.rooms {
+		// Most clients take every robot and can share one keyframe.
+		all, ok := r.delta.keyframe(func(string, *stateFields) bool { return true }, h.opts.Envelope)
+		if !ok {
+			continue
+		}
+		for client := range r.clients {
+			if !h.filtering || client.takesAll() {
+				client.queue(all)
+			} else if msg, ok := r.delta.keyframe(h.keyframeFilter(client), h.opts.Envelope); ok {
+				client.queue(msg)
+			}
+		}
+	}
+}
+
+// keyframeFilter returns which robots belong in a keyframe for c: like the
+// "filter" stage does for broadcasts, the ones it subscribed to and whose
+// latest state passes its filter. Without that stage, every robot.
+func (h *Hub) keyframeFilter(c *Client) func(id string, fields *stateFields) bool {
+	return func(id string, fields *stateFields) bool {
+		return !h.filtering || c.accepts(id, fields)
+	}
+}
+
+// CloseAll sends a close frame with the given code and reason to every client,
+// closes the connections and empties the hub. Writes give up at `deadline`.
+func (h *Hub) CloseAll(code int, reason string, deadline time.Time) {
+	msg := websocket.FormatCloseMessage(code, reason)
+
+	// Take the clients out of the hub under the lock, but do the (possibly slow)
+	// network writes after releasing it, so Register, Unregister and Run aren't held up.
+	h.mutex.Lock()
+	closing := make([]*Client, 0, h.count)
+	for _, r := range h.rooms {
+		for client := range r.clients {
+			h.leave(client)
+			h.endSession(client)
+			closing = append(closing, client)
+		}
+	}
+	h.count = 0
+	h.mutex.Unlock()
+
+	// Say goodbye to all clients in parallel, one that doesn't read can't use up
+	// the deadline for the ones after it.
+	var wg sync.WaitGroup
+	for _, client := range closing {
+		// SYNTAX: wg.Go (Go 1.25) runs the function in a new goroutine and tracks it in the group.
+		wg.Go(func() {
+			client.setReason(reasonShutdown)
+			// WriteControl may be called concurrently with the writePump's WriteMessage.
+			client.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+			// Only now stop the writePump, it closes the connection on its way out.
+			// Closing `send` outside the lock is safe: the client is no longer in
+			// the map, so neither Run nor Unregister touch it anymore.
+			close(client.send)
+			client.conn.Close()
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeConn is an in-memory Conn. Reads block until it is closed, writes are
+// recorded (or fail with writeErr), a slow one holds every control frame
+// until its deadline like a peer that doesn't read.
+type fakeConn struct {
+	writeErr error
+	slow     bool
+	// panics makes WriteMessage panic, like a bug while serving the client.
+	panics bool
+
+	mutex    sync.Mutex
+	frames   [][]byte
+	controls []int
+	// closeAt is when the first close frame was written, zero before,
+	// closeCode the code it carried.
+	closeAt   time.Time
+	closeCode int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	<-c.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (c *fakeConn) WriteMessage(messageType int, data []byte) error {
+	if c.panics {
+		panic("fake write panicked")
+	}
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.frames = append(c.frames, append([]byte(nil), data...))
+	return nil
+}
+
+func (c *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if c.slow {
+		select {
+		case <-time.After(time.Until(deadline)):
+			return errors.New("write timeout")
+		case <-c.closed:
+			return net.ErrClosed
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.controls = append(c.controls, messageType)
+	if messageType == websocket.CloseMessage && c.closeAt.IsZero() {
+		c.closeAt = time.Now()
+		if len(data) >= 2 {
+			c.closeCode = int(binary.BigEndian.Uint16(data))
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(time.Time) error           { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error          { return nil }
+func (c *fakeConn) SetPongHandler(func(appData string) error) {}
+func (c *fakeConn) RemoteAddr() net.Addr                      { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234} }
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// written returns the data frames written so far.
+func (c *fakeConn) written() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([][]byte(nil), c.frames...)
+}
+
+// closeFrameAt returns when the close frame was written, zero if it wasn't.
+func (c *fakeConn) closeFrameAt() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closeAt
+}
+
+// isClosed reports whether Close was called.
+func (c *fakeConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// register adds a client on a fake connection to hub, without pumps.
+func register(t testing.TB, hub *Hub, conn *fakeConn) *Client {
+	t.Helper()
+	client := newClient(conn, 0)
+	if _, err := hub.Register(client); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestCloseAllIsNotHeldUpBySlowClients(t *testing.T) {
+	hub := NewHub(HubOptions{QueueSize: 16})
+	healthy := []*fakeConn{newFakeConn(), newFakeConn(), newFakeConn()}
+	for _, conn := range healthy {
+		register(t, hub, conn)
+	}
+	slow := newFakeConn()
+	slow.slow = true
+	register(t, hub, slow)
+	failing := newFakeConn()
+	failing.writeErr = errors.New("broken pipe")
+	register(t, hub, failing)
+
+	const grace = time.Second
+	start := time.Now()
+	hub.CloseAll(websocket.CloseGoingAway, "server shutting down", start.Add(grace))
+	took := time.Since(start)
+
+	for i, conn := range healthy {
+		at := conn.closeFrameAt()
+		if at.IsZero() {
+			t.Fatalf("healthy client %d got no close frame", i)
+		}
+		if wait := at.Sub(start); wait > grace/4 {
+			t.Errorf("healthy client %d got its close frame after %v, behind the slow client", i, wait)
+		}
+		if !conn.isClosed() {
+			t.Errorf("healthy client %d wasn't closed", i)
+		}
+	}
+	if !slow.isClosed() || !failing.isClosed() {
+		t.Error("slow or failing client wasn't closed")
+	}
+	// The slow client may use up the deadline, but not more.
+	if took > grace+grace/2 {
+		t.Errorf("CloseAll took %v, past the %v deadline", took, grace)
+	}
+	if n := hub.Count(); n != 0 {
+		t.Errorf("hub still counts %d clients", n)
+	}
+}
+
+// serve runs serveClient for a new client on conn until the connection ends.
+// It returns the client and a channel closed when serveClient returned.
+func serve(t *testing.T, hub *Hub, conn *fakeConn) (*Client, <-chan struct{}) {
+	t.Helper()
+	client := newClient(conn, 0)
+	done := make(chan struct{})
+	go func() {
+		serveClient(context.Background(), hub, client, EndpointOptions{})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return client, done
+}
+
+// frame is the i-th test broadcast.
+func frame(i int) []byte {
+	return []byte(`{"id":"robot_1","x":` + strconv.Itoa(i) + `}`)
+}
+
+func TestHubFansOutToEveryClient(t *testing.T) {
+	hub := startHub(t, HubOptions{})
+	conns := []*fakeConn{newFakeConn(), newFakeConn(), newFakeConn()}
+	for _, conn := range conns {
+		serve(t, hub, conn)
+	}
+	waitFor(t, "the clients to register", func() bool { return hub.Count() == len(conns) })
+
+	const frames = 10
+	for i := range frames {
+		hub.Broadcast(Message{Type: websocket.TextMessage, Data: frame(i)})
+	}
+	for n, conn := range conns {
+		waitFor(t, "every frame to arrive", func() bool { return len(conn.written()) == frames })
+		for i, got := range conn.written() {
+			if !bytes.Equal(got, frame(i)) {
+				t.Errorf("client %d frame %d = %s, want %s", n, i, got, frame(i))
+			}
+		}
+	}
+}
+
+func TestHubCountsDropsOfAFullQueue(t *testing.T) {
+	// Room for every broadcast, only the client's queue may overflow.
+	hub := startHub(t, HubOptions{QueueSize: 2 * sendBufferSize})
+	// No writePump, nothing empties the queue.
+	client := register(t, hub, newFakeConn())
+
+	const extra = 5
+	for i := range sendBufferSize + extra {
+		hub.Broadcast(Message{Type: websocket.TextMessage, Data: frame(i)})
+	}
+	waitFor(t, "the overflow to be dropped", func() bool { return client.Dropped() == extra })
+	if n := len(client.send); n != sendBufferSize {
+		t.Errorf("queue holds %d messages, want it full with %d", n, sendBufferSize)
+	}
+	// The queue keeps the oldest messages, the newest ones were dropped.
+	if msg := <-client.send; !bytes.Equal(msg.Data, frame(0)) {
+		t.Errorf("head of the queue = %s, want %s", msg.Data, frame(0))
+	}
+}
+
+func TestHubUnregistersClientWhoseWriteFails(t *testing.T) {
+	hub := startHub(t, HubOptions{})
+	broken := newFakeConn()
+	broken.writeErr = errors.New("broken pipe")
+	client, done := serve(t, hub, broken)
+	healthy := newFakeConn()
+	serve(t, hub, healthy)
+	waitFor(t, "the clients to register", func() bool { return hub.Count() == 2 })
+
+	hub.Broadcast(Message{Type: websocket.TextMessage, Data: frame(0)})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client whose write failed is still being served")
+	}
+	if n := hub.Count(); n != 1 {
+		t.Errorf("hub counts %d clients, want only the healthy one", n)
+	}
+	if !broken.isClosed() {
+		t.Error("connection of the failed client wasn't closed")
+	}
+	if reason := client.disconnectReason(); reason != reasonWriteError {
+		t.Errorf("disconnect reason = %q, want %q", reason, reasonWriteError)
+	}
+	waitFor(t, "the healthy client's frame", func() bool { return len(healthy.written()) == 1 })
+}
+
+// BenchmarkDeliver measures one broadcast reaching N clients, without the
+// sockets. The queues are emptied with the timer stopped, so every message
+// is queued and none takes the cheaper drop path.
+func BenchmarkDeliver(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(strconv.Itoa(n)+"-clients", func(b *testing.B) {
+			hub := NewHub(HubOptions{QueueSize: 16})
+			clients := make([]*Client, n)
+			for i := range clients {
+				clients[i] = register(b, hub, newFakeConn())
+			}
+
+			msg := Message{Type: websocket.TextMessage, Data: telemetry, RobotID: "robot_1"}
+			b.ReportAllocs()
+			queued := 0
+			for b.Loop() {
+				hub.deliver(msg)
+				if queued++; queued == sendBufferSize {
+					b.StopTimer()
+					for _, client := range clients {
+						for len(client.send) > 0 {
+							<-client.send
+						}
+					}
+					queued = 0
+					b.StartTimer()
+				}
+			}
+			for _, client := range clients {
+				if client.Dropped() > 0 {
+					b.Fatalf("client dropped %d messages", client.Dropped())
+				}
+			}
+		})
+	}
+}
+
+// Packets name their room themselves, a flood of made-up names mustn't
+// create rooms without end. Configured rooms always get through.
+func TestHubCapsRoomsNamedByPackets(t *testing.T) {
+	hub := NewHub(HubOptions{QueueSize: 16, MaxRooms: 2, Rooms: []string{"swarm-a"}})
+	deliver := func(room string) bool {
+		return hub.deliver(Message{Type: websocket.TextMessage, Data: frame(0), Room: room})
+	}
+	for _, room := range []string{"made-up-1", "made-up-2", "made-up-1"} {
+		if !deliver(room) {
+			t.Errorf("message for %q dropped below the limit", room)
+		}
+	}
+	if deliver("made-up-3") {
+		t.Error("message for a third made-up room delivered past -max-rooms")
+	}
+	for _, room := range []string{defaultRoom, "swarm-a", "made-up-2"} {
+		if !deliver(room) {
+			t.Errorf("message for %q dropped, its room is configured or already exists", room)
+		}
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if n := len(hub.rooms); n != 4 {
+		t.Errorf("hub has %d rooms, want 4 (default, swarm-a and two made up)", n)
+	}
+}
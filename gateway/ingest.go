@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json" // For the response body
+	"log/slog"      // For logging the switch
+	"net/http"      // For the handlers
+)
+
+// --- Ingest Pause ---
+// While the simulation restarts it sends half-initialized worlds, robots at the
+// origin and the like, which clients would render. "POST /ingest/pause" on the
+// admin server stops forwarding without disconnecting anyone:
+// packets are still read and counted (gateway_udp_packets_received_total keeps
+// growing), but Run drops them (gateway_messages_paused_total) before the
+// pipeline, so the cached last state, the history and dedup/delta stay as they
+// were before the pause. New clients get that last state as usual. Heartbeats
+// (-heartbeat) go on, which tells clients the gateway is still there.
+// "POST /ingest/resume" forwards again; the next packet updates everyone.
+// Both, and "GET /ingest", answer with the current state, e.g. {"paused":true}.
+// Anyone who can reach the admin server may read it, the two switches need
+// what "/notify" needs (see requireOperator).
+
+// ingestState is the JSON body of the "/ingest" endpoints.
+type ingestState struct {
+	Paused bool `json:"paused"`
+}
+
+// PauseIngest stops (paused = true) or resumes forwarding of incoming
+// messages, see ingest.go. It returns false if the hub already was in that state.
+func (h *Hub) PauseIngest(paused bool) bool {
+	return h.ingestPaused.Swap(paused) != paused
+}
+
+// IngestPaused reports whether forwarding of incoming messages is paused.
+func (h *Hub) IngestPaused() bool {
+	return h.ingestPaused.Load()
+}
+
+// handleIngest returns the handler for "GET /ingest".
+func handleIngest(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeIngestState(w, hub)
+	}
+}
+
+// handleIngestSwitch returns the handler for "POST /ingest/pause" (paused is
+// true) or "POST /ingest/resume" (false). GET only reports the state.
+func handleIngestSwitch(hub *Hub, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if hub.PauseIngest(paused) {
+				slog.Info("ingest switched", "paused", paused, "remote", r.RemoteAddr)
+			}
+		case http.MethodGet:
+		default:
+			w.Header().Set("Allow", http.MethodPost+", "+http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeIngestState(w, hub)
+	}
+}
+
+// writeIngestState answers with the current ingestState.
+func writeIngestState(w http.ResponseWriter, hub *Hub) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ingestState{Paused: hub.IngestPaused()})
+}
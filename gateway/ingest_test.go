@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Pausing the ingest blanks every client's view, a page the operator happens
+// to have open mustn't be able to do it.
+func TestIngestSwitchesNeedAnOperator(t *testing.T) {
+	tokens, err := parseAuthTokens("alice:s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(HubOptions{QueueSize: 16})
+	admin := newAdminServer("", hub, nil, EndpointOptions{}, false, parseOrigins("*"), tokens).Handler
+	request := func(method, path, origin, bearer string) int {
+		r := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, path := range []string{"/ingest/pause", "/ingest/resume"} {
+		if code := request(http.MethodPost, path, "", ""); code != http.StatusUnauthorized {
+			t.Errorf("POST %s without token: status = %d, want 401", path, code)
+		}
+		if code := request(http.MethodPost, path, "https://evil.example", "s3cret"); code != http.StatusForbidden {
+			t.Errorf("POST %s from a foreign page: status = %d, want 403", path, code)
+		}
+	}
+	if hub.IngestPaused() {
+		t.Fatal("a refused request paused the ingest")
+	}
+
+	if code := request(http.MethodPost, "/ingest/pause", "", "s3cret"); code != http.StatusOK {
+		t.Fatalf("POST /ingest/pause with token: status = %d, want 200", code)
+	}
+	if !hub.IngestPaused() {
+		t.Error("ingest not paused")
+	}
+	// Reading the state stays open, like "/stats".
+	if code := request(http.MethodGet, "/ingest", "", ""); code != http.StatusOK {
+		t.Errorf("GET /ingest without token: status = %d, want 200", code)
+	}
+	if code := request(http.MethodPost, "/ingest/resume", "", "s3cret"); code != http.StatusOK {
+		t.Fatalf("POST /ingest/resume with token: status = %d, want 200", code)
+	}
+	if hub.IngestPaused() {
+		t.Error("ingest still paused")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"slices"      // For sorting a copy of the samples
+	"sync/atomic" // For recording without a lock
+	"time"        // For durations
+)
+
+// --- Latency Percentiles ---
+// gateway_delivery_latency_seconds needs Prometheus to be read. For "/stats"
+// the most recent delivery latencies (UDP in to WebSocket out, see Client.write)
+// are also kept in a small ring, and percentiles are computed from it on request.
+// Recording is one atomic add and one atomic store, writePumps never wait for each other.
+// With many clients the ring covers only the last moments, which is what
+// "how is the pipeline doing right now" is about.
+
+// latencySamples is the size of the ring. A power of two keeps the index a cheap mask.
+const latencySamples = 4096
+
+// latencyRing holds the newest latencySamples latencies, in nanoseconds.
+type latencyRing struct {
+	next    atomic.Uint64
+	samples [latencySamples]atomic.Int64
+}
+
+// deliveryLatencies are the delivery latencies for "/stats".
+var deliveryLatencies latencyRing
+
+// observeDelivery records the latency of one message written to a client
+// in both /stats and /metrics.
+func observeDelivery(latency time.Duration) {
+	deliveryLatency.Observe(latency.Seconds())
+	deliveryLatencies.add(latency)
+}
+
+// add records one latency. Concurrent adds may overwrite each other's slot
+// once the ring wraps around, losing a sample now and then is fine.
+func (r *latencyRing) add(d time.Duration) {
+	i := r.next.Add(1) - 1
+	r.samples[i&(latencySamples-1)].Store(int64(d))
+}
+
+// latencyPercentiles is the "delivery_latency_ms" field of "/stats".
+type latencyPercentiles struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+// percentiles returns the percentiles of the samples in the ring, in milliseconds.
+// It sorts a copy, the ring keeps being written meanwhile.
+func (r *latencyRing) percentiles() latencyPercentiles {
+	n := int(min(r.next.Load(), latencySamples))
+	if n == 0 {
+		return latencyPercentiles{}
+	}
+	sorted := make([]int64, n)
+	for i := range sorted {
+		sorted[i] = r.samples[i].Load()
+	}
+	slices.Sort(sorted)
+	// Nearest rank: the smallest sample that at least p of the samples are <= to.
+	at := func(p float64) float64 {
+		i := min(n-1, int(p*float64(n)))
+		return float64(sorted[i]) / float64(time.Millisecond)
+	}
+	return latencyPercentiles{Samples: n, P50: at(0.50), P95: at(0.95), P99: at(0.99)}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "log/slog" // For the level
+
+// watchLogLevel does nothing, there is no SIGUSR1 outside Unix.
+func watchLogLevel(level *slog.LevelVar, base slog.Level) {}
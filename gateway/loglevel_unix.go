@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"  // For the level
+	"os"        // For os.Signal
+	"os/signal" // For receiving SIGUSR1
+	"syscall"   // For the SIGUSR1 constant
+)
+
+// watchLogLevel switches the log level between `base` (the -log-level) and
+// debug every time the process receives SIGUSR1 (`kill -USR1 <pid>`, or
+// `docker kill -s USR1 <container>`), so debug logs of a live problem can be
+// captured without a restart. With -log-level debug it toggles to info instead.
+func watchLogLevel(level *slog.LevelVar, base slog.Level) {
+	other := slog.LevelDebug
+	if base == slog.LevelDebug {
+		other = slog.LevelInfo
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			next := other
+			if level.Level() == other {
+				next = base
+			}
+			level.Set(next)
+			// Logged at the level that is always shown, so the switch is visible either way.
+			slog.Warn("log level changed", "level", next.String())
+		}
+	}()
+}
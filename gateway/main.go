@@ -2,10 +2,22 @@
 package main
 
 import (
-	"fmt"       // For formatted I/O (like printing to the console)
-	"net"       // For networking operations (UDP)
-	"net/http"  // For building HTTP servers and clients (WebSocket is built on top of HTTP)
-	"sync"      // Provides synchronization primitives, like mutexes
+	"context"       // For deadlines and cancellation (stopping goroutines, bounding the shutdown)
+	"crypto/tls"    // For TLS on the TCP listener
+	"encoding/json" // For the 426 response body
+	"errors"        // For inspecting wrapped errors (e.g. net.ErrClosed)
+	"fmt"           // For error messages
+	"log/slog"      // For structured (JSON) logging
+	"net"           // For networking operations (UDP, TCP)
+	"net/http"      // For building HTTP servers and clients (WebSocket is built on top of HTTP)
+	"os"            // For OS-level types like os.Signal
+	"os/signal"     // For receiving OS signals (Ctrl+C, docker stop)
+	"slices"        // For checking the -pipeline stages
+	"strconv"       // For parsing resume tokens
+	"strings"       // For splitting comma-separated flag values
+	"sync"          // For the write buffer pool
+	"syscall"       // For the SIGTERM constant
+	"time"          // For timeouts
 
 	"github.com/gorilla/websocket" // A popular Go library for working with WebSockets
 )
@@ -13,136 +25,743 @@ import (
 // --- WebSocket Configuration ---
 
 // upgrader holds the WebSocket upgrader configuration.
-// We configure it to allow all origins, which is useful for development
+// Its CheckOrigin is set in `main` from the -allowed-origins flag (see origins.go).
+// The default "*" allows all origins, which is useful for development
 // when the web client is served from a different port (Vite dev server).
+// Note that TLS (-tls-cert/-tls-key) doesn't change this: wss:// handshakes go
+// through CheckOrigin exactly like plain ws:// ones.
 // SYNTAX: `var` declares a variable. `upgrader` is the variable name.
 // `websocket.Upgrader{...}` is creating an instance of a struct.
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// `func(...) bool { ... }` is an anonymous function.
-		// It returns `true` to indicate that any request origin is acceptable.
-		return true
-	},
-}
-
-// --- Global State for Connection Management ---
-
-// clients is a map to store all active WebSocket client connections.
-// The keys are pointers to websocket.Conn objects, and the values are booleans.
-// We use a map for efficient addition and removal of clients.
-// SYNTAX: `make(map[keyType]valueType)` creates a map.
-var clients = make(map[*websocket.Conn]bool)
+var upgrader = websocket.Upgrader{}
 
-// broadcast is a channel that acts as a queue for messages received from the simulation.
-// Messages sent to this channel will be forwarded to all connected WebSocket clients.
-// SYNTAX: `make(chan dataType)` creates a channel. Channels are a core concurrency feature in Go for safe communication.
-var broadcast = make(chan []byte)
-
-// mutex is a "mutual exclusion lock". It's used to prevent race conditions
-// when multiple goroutines (concurrent threads) access the `clients` map simultaneously.
-// SYNTAX: `&sync.Mutex{}` creates a pointer to a new Mutex object.
-var mutex = &sync.Mutex{}
+// shutdownTimeout bounds how long a graceful shutdown may take.
+// After this a stuck client can no longer keep the process alive.
+const shutdownTimeout = 5 * time.Second
 
 // --- Main Application Logic ---
 
 // main is the entry function for the application.
 func main() {
-	// Start a new goroutine to listen for UDP data from the Rust simulation.
-	// SYNTAX: `go` keyword starts a new goroutine, which is like a lightweight thread managed by the Go runtime.
-	go startUDPServer()
-
-	// Register the handleConnections function to handle all incoming HTTP requests to the "/ws" endpoint.
-	// This is where clients will connect to establish a WebSocket connection.
-	http.HandleFunc("/ws", handleConnections)
-
-	// Start the HTTP server.
-	fmt.Println("Gateway listening on :8080 (WS) and :8000 (UDP)...")
-	// http.ListenAndServe starts a server that listens on the specified TCP network address.
-	// This is a blocking call, so the main goroutine will be "stuck" here, keeping the server alive.
-	// The ":8080" is the port inside the Docker container.
-	err := http.ListenAndServe(":8080", nil) // inside port of the docker container
+	// --- Configuration ---
+	// Flags and GATEWAY_* environment variables, see config.go.
+	cfg := mustLoadConfig()
+
+	// --- Logging ---
+	// Every log line is a JSON object, so `docker compose logs` output can be filtered with tools like `jq`.
+	// SetDefault makes the package-level functions (slog.Info, slog.Error, ...) use this logger.
+	// SYNTAX: a slog.LevelVar can be changed while the handler uses it, see watchLogLevel.
+	var logLevel slog.LevelVar
+	logLevel.Set(cfg.LogLevel)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})))
+	watchLogLevel(&logLevel, cfg.LogLevel)
+
+	codec, err := codecByName(cfg.Codec)
 	if err != nil {
-		// If the server fails to start (e.g., port is already in use), the program will exit.
-		// `panic` is a built-in function that stops the ordinary flow of control and begins panicking.
-		panic(err)
+		fatal("invalid codec", err)
 	}
-}
 
-// --- Concurrent Goroutines ---
+	if cfg.Gen {
+		if cfg.GenHz <= 0 || cfg.GenRobots <= 0 {
+			fatal("invalid generator configuration", errors.New("-gen-hz and -gen-robots must be positive"))
+		}
+		// runGenerator only returns on error, Ctrl+C simply ends the process.
+		if err := runGenerator(GenOptions{Target: cfg.GenTarget, Robots: cfg.GenRobots, Hz: cfg.GenHz, Codec: codec}); err != nil {
+			fatal("generator failed", err)
+		}
+		return
+	}
+
+	// Half a TLS configuration is almost certainly a typo, refuse to silently fall back to plaintext.
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		fatal("invalid TLS configuration", errors.New("-tls-cert and -tls-key must be set together"))
+	}
+	useTLS := cfg.TLSCert != ""
+
+	if cfg.Sanitize && cfg.SanitizeBound <= 0 {
+		fatal("invalid configuration", errors.New("-sanitize-bound must be positive"))
+	}
+	if cfg.SlowFill <= 0 || cfg.SlowFill > 1 {
+		fatal("invalid configuration", errors.New("-slow-fill must be in (0, 1]"))
+	}
+	udpAllow, err := parseSenderAllowlist(cfg.UDPAllow)
+	if err != nil {
+		fatal("invalid -udp-allow", err)
+	}
+	authTokens, err := parseAuthTokens(cfg.AuthToken)
+	if err != nil {
+		fatal("invalid -auth-token", err)
+	}
+	switch cfg.SingleSession {
+	case sessionsOff:
+	case sessionsReject, sessionsReplace:
+		if authTokens == nil {
+			fatal("invalid configuration", errors.New("-single-session needs -auth-token to tell clients apart"))
+		}
+	default:
+		fatal("invalid configuration", fmt.Errorf("-single-session must be off, reject or replace, not %q", cfg.SingleSession))
+	}
+	if cfg.UDPReaders < 1 {
+		fatal("invalid configuration", errors.New("-udp-readers must be at least 1"))
+	}
+	if cfg.UDPReaders > 1 && !reusePortSupported {
+		fatal("invalid configuration", errors.New("-udp-readers above 1 needs SO_REUSEPORT load balancing, which only Linux has"))
+	}
+	// A buffer of 0 would read every packet as truncated and empty.
+	if cfg.UDPBuffer < 1 || cfg.UDPBuffer > maxUDPBuffer {
+		fatal("invalid configuration", fmt.Errorf("-udp-buffer must be between 1 and %d", maxUDPBuffer))
+	}
+	// Both the hub and the tap make their queue of this size.
+	if cfg.QueueSize < 0 {
+		fatal("invalid configuration", errors.New("-queue-size must not be negative"))
+	}
+	if cfg.Sample < 1 {
+		fatal("invalid configuration", errors.New("-sample must be at least 1"))
+	}
+	if cfg.UDPReadTimeout < 0 {
+		fatal("invalid configuration", errors.New("-udp-read-timeout must not be negative"))
+	}
+	if cfg.SilenceTimeout < 0 {
+		fatal("invalid configuration", errors.New("-silence-timeout must not be negative"))
+	}
+	if cfg.CloseGrace < 0 {
+		fatal("invalid configuration", errors.New("-close-grace must not be negative"))
+	}
+	// sendReliable divides -cmd-timeout by the attempts, and with no attempt at
+	// all it would acknowledge a command that was never sent.
+	if cfg.CmdRetries < 0 {
+		fatal("invalid configuration", errors.New("-cmd-retries must not be negative"))
+	}
+	if cfg.CmdTimeout < 0 {
+		fatal("invalid configuration", errors.New("-cmd-timeout must not be negative"))
+	}
+	if cfg.DropPolicy != "newest" && cfg.DropPolicy != "oldest" {
+		fatal("invalid configuration", fmt.Errorf("-drop-policy must be newest or oldest, not %q", cfg.DropPolicy))
+	}
+	stages, err := parsePipeline(cfg.Pipeline)
+	if err != nil {
+		fatal("invalid -pipeline", err)
+	}
+	// A feature left out of the pipeline would silently do nothing.
+	for stage, on := range map[string]bool{"dedup": cfg.Dedup, "delta": cfg.Delta, "envelope": cfg.Envelope} {
+		if on && !slices.Contains(stages, stage) {
+			fatal("invalid -pipeline", fmt.Errorf("-%s is on, but not part of %q", stage, cfg.Pipeline))
+		}
+	}
+	if cfg.MaxHz > 0 && !slices.Contains(stages, "decimate") {
+		fatal("invalid -pipeline", fmt.Errorf("-max-hz is set, but decimate is not part of %q", cfg.Pipeline))
+	}
+	if cfg.Coalesce && !cfg.Envelope {
+		fatal("invalid configuration", errors.New("-coalesce needs -envelope"))
+	}
+	// writePump only looks at the batch size, 1 writes every message on its own.
+	coalesce := 1
+	if cfg.Coalesce {
+		coalesce = cfg.CoalesceMax
+	}
+	if cfg.ErrorFrames && !cfg.Strict && cfg.SilenceTimeout == 0 {
+		fatal("invalid configuration", errors.New("-error-frames only applies to -strict and -silence-timeout"))
+	}
+
+	// Only pages served from these origins may open a WebSocket to us.
+	// SYNTAX: `origins.allow` is a "method value", a function bound to `origins`.
+	origins := parseOrigins(cfg.AllowedOrigins)
+	upgrader.CheckOrigin = origins.allow
+	// The versions of our message format a client can ask for, see format.go.
+	upgrader.Subprotocols = subprotocolNames()
+	// Telemetry is repetitive JSON and typically deflates very well. Compression is
+	// only used when the browser offers it during the handshake and applies to text and binary frames alike.
+	// gorilla compresses every message on its own (no context takeover), so this pays
+	// off for large frames (a whole swarm per packet) but can make tiny messages slightly bigger.
+	upgrader.EnableCompression = cfg.Compress
+	// A client that opens a TCP connection and never finishes the handshake
+	// would otherwise hold on to it (and a goroutine) forever.
+	upgrader.HandshakeTimeout = cfg.HandshakeTimeout
+	// Larger buffers mean fewer syscalls per large frame, at a cost per connection.
+	// A message larger than the write buffer is simply written in several pieces.
+	upgrader.ReadBufferSize = cfg.WSReadBuffer
+	upgrader.WriteBufferSize = cfg.WSWriteBuffer
+	// Without a pool every connection keeps its write buffer for its whole life
+	// (with the default size that's the one the HTTP server already allocated).
+	// With one, a buffer is only taken while a message is written, so idle
+	// connections cost none. Clients that all receive every broadcast write at
+	// the same moment and need all buffers at once anyway, that's why it is off by default.
+	if cfg.WSBufferPool {
+		upgrader.WriteBufferPool = &sync.Pool{}
+	}
+
+	// --- Data Source ---
+	// Either a recording is replayed, or we listen for the live simulation over UDP.
+	var (
+		udpAddrs   []ingestAddr
+		replayFile *recording
+	)
+	if cfg.ReplayPath != "" {
+		if cfg.ReplaySpeed <= 0 {
+			fatal("invalid replay configuration", errors.New("-replay-speed must be positive"))
+		}
+		if cfg.RecordPath != "" {
+			fatal("invalid replay configuration", errors.New("-record and -replay can't be combined"))
+		}
+		replayFile, err = openRecording(cfg.ReplayPath)
+		if err != nil {
+			fatal("opening replay file failed", err)
+		}
+	} else {
+		if !validUDPNetwork(cfg.UDPNetwork) {
+			fatal("invalid UDP network", fmt.Errorf("-udp-network must be udp, udp4 or udp6, not %q", cfg.UDPNetwork))
+		}
+		// Resolve the UDP addresses up front, a typo should stop us right away.
+		// They are bound further down, once the hub is ready.
+		// ":8000" means it will listen on port 8000 on all available network interfaces.
+		// With -udp-network "udp" (the default) that includes IPv6: Go opens a
+		// dual-stack socket that accepts IPv4 and IPv6 packets alike. "udp4" and
+		// "udp6" restrict it to one family, "[::1]:8000" or "0.0.0.0:8000" pick
+		// a family by the address itself.
+		// Several comma-separated addresses give one listener each, e.g. one per simulation shard.
+		// "unixgram:/path" listens on a Unix datagram socket instead, see udp.go.
+		for _, a := range strings.Split(cfg.UDPAddr, ",") {
+			addr, err := parseIngestAddr(cfg.UDPNetwork, strings.TrimSpace(a))
+			if err != nil {
+				fatal("invalid UDP address", err)
+			}
+			// SYNTAX: `append` adds elements to a slice, growing it as needed.
+			udpAddrs = append(udpAddrs, addr)
+		}
+	}
 
-// startUDPServer listens for incoming UDP packets from the simulation service.
-func startUDPServer() {
-	// Resolve the UDP address. ":8000" means it will listen on port 8000 on all available network interfaces.
-	// SYNTAX: `_` is the blank identifier. It's used to discard values you don't need. Here, we ignore the error.
-	addr, _ := net.ResolveUDPAddr("udp", ":8000")
-	
-	// Start listening for UDP packets on the resolved address.
-	conn, err := net.ListenUDP("udp", addr)
+	// Commands typed by operators in the browser travel the other way: WebSocket -> UDP.
+	// "Dialing" UDP sends nothing, it only fixes the destination for later writes.
+	cmdUDPAddr, err := net.ResolveUDPAddr("udp", cfg.CmdAddr)
 	if err != nil {
-		panic(err)
+		fatal("invalid command address", err)
+	}
+	cmdConn, err := net.DialUDP("udp", nil, cmdUDPAddr)
+	if err != nil {
+		fatal("command socket failed", err)
+	}
+
+	// Everything is validated, a dry run stops here before it creates files or binds for real.
+	if cfg.Check {
+		os.Exit(runCheck(os.Stdout, cfg, udpAddrs))
+	}
+
+	// Recording is optional. The recorder is closed (and flushed) during shutdown.
+	var recorder *Recorder
+	if cfg.RecordPath != "" {
+		recorder, err = NewRecorder(cfg.RecordPath)
+		if err != nil {
+			fatal("opening record file failed", err)
+		}
+		slog.Info("recording UDP stream", "path", cfg.RecordPath)
+	}
+
+	// ctx is canceled as the last step of shutdown. Every long-running goroutine
+	// (hub, data sources, client writers) watches it, so nothing outlives it.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The hub owns the set of connected clients and fans messages out to them.
+	hub := NewHub(HubOptions{
+		MaxClients:       cfg.MaxClients,
+		CacheLast:        cfg.CacheLast,
+		QueueSize:        cfg.QueueSize,
+		QueueRetry:       cfg.QueueRetry,
+		DropOldest:       cfg.DropPolicy == "oldest",
+		Heartbeat:        cfg.Heartbeat,
+		Envelope:         cfg.Envelope,
+		Dedup:            cfg.Dedup,
+		Delta:            cfg.Delta,
+		KeyframeInterval: cfg.KeyframeInterval,
+		History:          cfg.HistorySize,
+		HistoryMaxAge:    cfg.HistoryMaxAge,
+		Workers:          cfg.BroadcastWorkers,
+		RequireHello:     cfg.RequireHello,
+		SingleSession:    cfg.SingleSession,
+		Pipeline:         stages,
+		MaxRooms:         cfg.MaxRooms,
+		Rooms:            listenerRooms(udpAddrs),
+	})
+	registerHubMetrics(hub)
+	// The raw tap for "/ws/raw" on the admin server, see tap.go. Without the
+	// admin server there is no one to tap for.
+	var tap *Hub
+	if cfg.AdminAddr != "" {
+		tap = newTapHub(cfg.QueueSize)
+		go supervise(ctx, "tap", cfg.RecoverPanics, tap.Run)
+	}
+	// SYNTAX: `go` keyword starts a new goroutine, which is like a lightweight thread managed by the Go runtime.
+	// A panic in Run (or in a source below) is recovered and the goroutine restarted, see supervise.go.
+	go supervise(ctx, "broadcaster", cfg.RecoverPanics, hub.Run)
+
+	// Without -strict bad packets are forwarded, clients see them anyway.
+	var sanitize *sanitizer
+	if cfg.Sanitize {
+		sanitize = newSanitizer(cfg.SanitizeBound)
+	}
+	var errorFrames *errorReporter
+	if cfg.ErrorFrames {
+		errorFrames = newErrorReporter(hub, cfg.Envelope)
+	}
+	// Tells "the simulation stopped" apart from "nobody is watching", see silence.go.
+	if cfg.SilenceTimeout > 0 {
+		go watchSilence(ctx, cfg.SilenceTimeout, errorFrames)
+	}
+	udpOpts := UDPOptions{
+		Codec:         codec,
+		TranscodeJSON: cfg.ToJSON,
+		Strict:        cfg.Strict,
+		Errors:        errorFrames,
+		Sanitize:      sanitize,
+		Binary:        cfg.Binary,
+		BufferSize:    cfg.UDPBuffer,
+		MaxPPS:        cfg.UDPMaxPPS,
+		MaxBPS:        cfg.UDPMaxBPS,
+		Recorder:      recorder,
+		TagSource:     cfg.TagSource,
+		Allow:         udpAllow,
+		Sample:        cfg.Sample,
+		ReadTimeout:   cfg.UDPReadTimeout,
+		Tap:           tap,
+	}
+	listeners := newUDPListeners(cfg.UDPNetwork, cfg.UDPReaders)
+	if replayFile != nil {
+		// Play the recording as if the simulation were sending it.
+		slog.Info("replaying recording", "path", cfg.ReplayPath, "speed", cfg.ReplaySpeed, "loop", cfg.ReplayLoop)
+		go startReplay(ctx, replayFile, hub, udpOpts, ReplayOptions{Speed: cfg.ReplaySpeed, Loop: cfg.ReplayLoop})
+	} else {
+		// Start a new goroutine per address to listen for UDP data from the Rust simulation.
+		// They all feed the same hub. Binding may have to wait for a port that is still
+		// in use (e.g. during a redeploy). Meanwhile the HTTP server already serves
+		// clients, with the cached last state of any listener that is up.
+		// `listeners` lets shutdown close whatever got bound.
+		// With -udp-readers every UDP address gets several sockets, each read by
+		// its own goroutine, see reuseport_linux.go.
+		for _, addr := range udpAddrs {
+			// SYNTAX: structs are copied on assignment, changing opts leaves udpOpts alone.
+			opts := udpOpts
+			opts.Room = addr.room
+			limiter := newIngressLimiter(opts)
+			activity := newUDPActivity(addr.String())
+			readers := cfg.UDPReaders
+			if addr.unix != nil {
+				readers = 1
+			}
+			for reader := range readers {
+				name := "udp:" + addr.String()
+				if readers > 1 {
+					name = fmt.Sprintf("%s#%d", name, reader)
+				}
+				go func() {
+					conn, err := listeners.listen(ctx, addr, cfg.UDPRetry)
+					if errors.Is(err, errListenersClosed) {
+						return
+					}
+					if err != nil {
+						fatal("UDP listen failed", err)
+					}
+					supervise(ctx, name, cfg.RecoverPanics, func(ctx context.Context) {
+						startUDPServer(ctx, conn, hub, opts, limiter, activity)
+					})
+				}()
+			}
+		}
+	}
+
+	// The public server gets its own mux instead of http.DefaultServeMux, which
+	// any imported package may add handlers to (net/http/pprof does, see admin.go).
+	mux := http.NewServeMux()
+
+	// Register the handlers returned by handleConnections for the WebSocket endpoints.
+	// This is where clients will connect to establish a WebSocket connection:
+	// "/ws" passes every message through, "/ws/lite" is decimated to -max-hz for
+	// clients on slow links. Both share the hub, so they count towards the same -max-clients.
+	// With -auth-token set, requireToken rejects unauthenticated clients before they are upgraded.
+	endpoint := EndpointOptions{
+		Commands:         cmdConn,
+		CmdRate:          cfg.CmdRate,
+		ValidateCommands: cfg.ValidateCommands,
+		CmdRetries:       cfg.CmdRetries,
+		CmdTimeout:       cfg.CmdTimeout,
+		IdleTimeout:      cfg.IdleTimeout,
+		SlowFill:         cfg.SlowFill,
+		SlowAfter:        cfg.SlowAfter,
+		Coalesce:         coalesce,
+		MaxMessageSize:   cfg.MaxMessageSize,
+		RecoverPanics:    cfg.RecoverPanics,
+	}
+	mux.Handle("/ws", requireToken(authTokens, handleConnections(hub, endpoint)))
+	lite := endpoint
+	lite.MaxHz = cfg.MaxHz
+	mux.Handle("/ws/lite", requireToken(authTokens, handleConnections(hub, lite)))
+	// The current state once, without a WebSocket, see snapshot.go. It carries the
+	// same data as "/ws", so it needs the same token. Dashboards on the allowed
+	// origins may fetch it, see cors.go.
+	mux.Handle("/snapshot", withCORS(origins, requireToken(authTokens, handleSnapshot(hub))))
+	// Metrics, stats, probes and profiling are on the admin server, see admin.go.
+
+	// We build an explicit `http.Server` (instead of calling `http.ListenAndServe`)
+	// because only a server value has a `Shutdown` method.
+	// Requests get contexts derived from ctx, so WebSocket clients, whose requests
+	// last as long as the connection, are stopped by it too.
+	server := &http.Server{
+		Addr:        cfg.WSAddr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
-	// `defer` schedules a function call to be run immediately before the function `startUDPServer` returns.
-	// It's a great way to ensure resources are cleaned up.
-	defer conn.Close()
 
-	// Create a buffer to hold the incoming data. 1024 bytes is a common size.
-	buf := make([]byte, 1024)
+	// Start the HTTP server in its own goroutine so `main` is free to wait for signals.
+	go func() {
+		slog.Info("gateway listening", "commit", currentBuild().Commit, "ws_addr", cfg.WSAddr, "udp_addr", cfg.UDPAddr, "cmd_addr", cfg.CmdAddr, "tls", useTLS)
+		// ListenAndServe(TLS) always returns a non-nil error. `http.ErrServerClosed` is the
+		// expected one after `Shutdown`, anything else means the server failed to start
+		// (e.g., port is already in use, unreadable certificate) and the program will exit.
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", err)
+		}
+	}()
 
-	// `for {}` is an infinite loop, so the server listens indefinitely.
-	for {
-		// Read data from the UDP connection into the buffer.
-		// `n` is the number of bytes read.
-		n, _, err := conn.ReadFromUDP(buf)
+	// Tools that would rather read length-prefixed frames than speak WebSocket
+	// connect here, see tcp.go. They get what "/ws" clients get.
+	var tcpListener net.Listener
+	if cfg.TCPAddr != "" {
+		tcpListener, err = net.Listen("tcp", cfg.TCPAddr)
 		if err != nil {
-			// If there's an error, skip to the next iteration.
-			continue
+			fatal("TCP listen failed", err)
+		}
+		// The HTTP server loads the certificate itself in ListenAndServeTLS, this one needs it here.
+		if useTLS {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+			if err != nil {
+				fatal("loading TLS certificate failed", err)
+			}
+			tcpListener = tls.NewListener(tcpListener, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+		go serveTCP(ctx, tcpListener, hub, authTokens, endpoint)
+	}
+
+	// Metrics, probes and other operator tools, on their own address, see admin.go.
+	var admin *http.Server
+	if cfg.AdminAddr != "" {
+		// The tap streams packets as received: no coalescing, no decimation.
+		// It is for watching, its clients can't steer the robots.
+		raw := endpoint
+		raw.Coalesce = 1
+		raw.Commands = nil
+		admin = newAdminServer(cfg.AdminAddr, hub, tap, raw, cfg.StatsClients, origins, authTokens)
+		go serveAdmin(admin)
+	}
+
+	// --- Wait for a shutdown signal ---
+	// `os.Interrupt` is Ctrl+C, `SIGTERM` is what `docker compose down` sends.
+	// SYNTAX: the channel is buffered (capacity 1) so the signal isn't lost if we're not ready to receive yet.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	slog.Info("shutting down gateway")
+	shutdown(server, admin, tcpListener, listeners, cmdConn, hub, tap, recorder, cfg.CloseGrace, cancel)
+}
+
+// fatal logs an error and exits the program. It is used instead of `panic` for
+// startup failures: one structured log line is easier to read than a stack trace.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// shutdown stops accepting new connections, closes the UDP sockets and the recording
+// (if any) and says goodbye to every connected WebSocket client. Finally it calls
+// `stop`, which cancels the context of all remaining goroutines.
+// With a `grace` period clients are told first and keep receiving data until
+// it is over, see restartMessage. The whole procedure is bounded by
+// shutdownTimeout plus the grace period.
+func shutdown(server, admin *http.Server, tcpListener net.Listener, listeners *udpListeners, cmdConn *net.UDPConn, hub, tap *Hub, recorder *Recorder, grace time.Duration, stop context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout+grace)
+	defer cancel()
+	// Canceling only at the end (instead of when the signal arrives) lets the
+	// steps below run in order, e.g. clients get their close frame before their
+	// writer goroutines go away.
+	defer stop()
+
+	// Stop accepting new HTTP connections. WebSocket connections are "hijacked"
+	// from the HTTP server, so Shutdown does not wait for them - we close them below.
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP shutdown incomplete", "err", err)
+	}
+	// The admin server (nil without -admin-addr) has no long-lived connections
+	// worth waiting for, a running profile is simply cut off. From here on
+	// probes fail, which is right: the gateway is going away.
+	if admin != nil {
+		admin.Close()
+	}
+	// The TCP listener (nil without -tcp-addr) only stops accepting, its clients
+	// are in the hub and closed with the WebSocket ones below.
+	if tcpListener != nil {
+		tcpListener.Close()
+	}
+
+	// Announce the restart while data still flows, so clients can spread
+	// their reconnects over the grace period instead of all reconnecting the
+	// moment the socket closes. SendAll queues it for every client under the hub's lock.
+	closeCode, closeReason := websocket.CloseGoingAway, "server shutting down"
+	if grace > 0 {
+		slog.Info("telling clients about the restart", "clients", hub.Count(), "grace", grace)
+		hub.SendAll(restartMessage(grace, hub.opts.Envelope))
+		time.Sleep(grace)
+		closeCode, closeReason = websocket.CloseServiceRestart, "server restarting"
+	}
+
+	// Stops the UDP listeners. There are none when replaying a recording.
+	listeners.Close()
+	// Clients still reading commands will just log failed writes until they are closed below.
+	cmdConn.Close()
+
+	// With the socket closed no more packets arrive, so the recording is complete.
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			slog.Warn("closing record file failed", "err", err)
 		}
-		
-		// Send the received data (a slice of the buffer from the start to `n`) to the broadcast channel.
-		// This will be picked up by the `handleConnections` function.
-		// SYNTAX: `channel <- value` sends a value into a channel.
-		broadcast <- buf[:n]
+	}
+
+	// The close frame is written with the context deadline, so a client that
+	// doesn't read can't block us past the shutdown timeout.
+	deadline, _ := ctx.Deadline()
+	hub.CloseAll(closeCode, closeReason, deadline)
+	// Like the admin server, the tap isn't worth a grace period.
+	if tap != nil {
+		tap.CloseAll(websocket.CloseGoingAway, "server shutting down", deadline)
 	}
 }
 
-// handleConnections is called for each new client connecting to the "/ws" WebSocket endpoint.
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	// Upgrade the initial HTTP connection to a persistent WebSocket connection.
+// --- Concurrent Goroutines ---
+
+// reject turns a request away. Browsers don't expose the HTTP status of a failed
+// WebSocket handshake (the page only sees close code 1006), so WebSocket
+// requests are upgraded and then closed with `code` and `reason`, which the
+// page can read. Other requests get a plain HTTP error with `status`.
+func reject(w http.ResponseWriter, r *http.Request, status, code int, reason string) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, reason, status)
+		return
+	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Println(err)
+		// The upgrader has already replied with an HTTP error.
 		return
 	}
-	// Ensure the connection is closed when the function returns.
-	defer ws.Close()
-
-	// --- Register New Client ---
-	// Lock the mutex to ensure that no other goroutine can access the `clients` map at the same time.
-	mutex.Lock()
-	// Add the new client connection to our map of clients.
-	clients[ws] = true
-	// Unlock the mutex so other goroutines can use it.
-	mutex.Unlock()
-
-	// --- Broadcast Loop ---
-	// This loop waits for a message to arrive on the `broadcast` channel.
-	// When a message is received, it's assigned to `msg` and the loop body executes.
-	for msg := range broadcast {
-		// Lock the mutex before iterating over the clients map.
-		mutex.Lock()
-		
-		// Iterate over all connected clients.
-		for client := range clients {
-			// Send the message to the current client.
-			err := client.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				// If there's an error (e.g., the client has disconnected),
-				// close their connection and remove them from the map.
-				client.Close()
-				delete(clients, client)
-			}
+	writeClose(ws, code, reason)
+	ws.Close()
+}
+
+// upgradeRequiredResponse is the JSON body of the 426 reply, see upgradeRequired.
+type upgradeRequiredResponse struct {
+	Error string `json:"error"`
+	Hint  string `json:"hint"`
+}
+
+// upgradeRequired answers a plain HTTP request (typically someone opening the
+// endpoint in a browser tab) with 426 Upgrade Required and a short explanation,
+// instead of the upgrader's terse "Bad Request".
+func upgradeRequired(w http.ResponseWriter, r *http.Request) {
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	// SYNTAX: the Upgrade header is required on a 426 by RFC 9110, it names the protocol to switch to.
+	w.Header().Set("Upgrade", "websocket")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUpgradeRequired)
+	json.NewEncoder(w).Encode(upgradeRequiredResponse{
+		Error: "this endpoint only accepts WebSocket connections",
+		Hint:  fmt.Sprintf("connect with a WebSocket client to %s://%s%s", scheme, r.Host, r.URL.Path),
+	})
+}
+
+// resumeFrom returns the sequence number a reconnecting client saw last, 0 if it
+// didn't send one. Browsers can't set headers on a WebSocket handshake, so besides
+// the Last-Event-ID header (as in Server-Sent Events) it may come as ?since=N.
+// The numbers are the "seq" of -envelope state frames, see Hub.Register.
+func resumeFrom(r *http.Request) uint64 {
+	token := r.URL.Query().Get("since")
+	if token == "" {
+		token = r.Header.Get("Last-Event-ID")
+	}
+	// A garbled token is treated like none, the client gets a full snapshot.
+	seq, _ := strconv.ParseUint(token, 10, 64)
+	return seq
+}
+
+// EndpointOptions configures one WebSocket endpoint, several endpoints can share a hub.
+type EndpointOptions struct {
+	// Commands is the socket that client messages are forwarded to. With nil
+	// the endpoint is read-only and they are dropped.
+	Commands *net.UDPConn
+
+	// CmdRate is the per-client command rate limit, 0 means unlimited.
+	CmdRate float64
+
+	// ValidateCommands only forwards commands that are a valid Command (see
+	// commands.go) and answers the others with an error frame.
+	ValidateCommands bool
+
+	// CmdRetries and CmdTimeout bound the attempts to forward a command that asks
+	// for an acknowledgement, see commands.go.
+	CmdRetries int
+	CmdTimeout time.Duration
+
+	// IdleTimeout disconnects clients that send nothing for this long, 0 disables it.
+	IdleTimeout time.Duration
+
+	// SlowAfter logs a warning about clients whose send queue stays at least
+	// SlowFill (0..1) full for this long, see slow.go. 0 disables the warnings.
+	SlowFill  float64
+	SlowAfter time.Duration
+
+	// Coalesce joins up to this many queued messages into one frame, see coalesce.go.
+	// Below 2 every message gets its own frame.
+	Coalesce int
+
+	// MaxMessageSize is the largest message a client may send, in bytes.
+	// 0 means no limit.
+	MaxMessageSize int64
+
+	// MaxHz decimates the stream of every client of this endpoint, see decimate.go.
+	// 0 passes every message through.
+	MaxHz float64
+
+	// RecoverPanics drops a client whose reader or writer panics instead of
+	// crashing the gateway, see recoverClient.
+	RecoverPanics bool
+}
+
+// handleConnections returns the handler for a WebSocket endpoint.
+// The returned closure captures `hub`, so every connection registers with the same hub,
+// and `opts`, which apply to every client connecting through this handler.
+func handleConnections(hub *Hub, opts EndpointOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A WebSocket handshake is always a GET (RFC 6455), anything else can't become one.
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Not a handshake at all, there is nothing to upgrade and nothing worth logging.
+		if !websocket.IsWebSocketUpgrade(r) {
+			upgradeRequired(w, r)
+			return
+		}
+
+		// The room to start in, see room.go. It can't be changed without a
+		// handshake in a browser, so it is in the query like ?since=.
+		roomName := r.URL.Query().Get("room")
+		if !validRoomName(roomName) {
+			reject(w, r, http.StatusBadRequest, websocket.ClosePolicyViolation, "invalid room")
+			return
+		}
+
+		// A client that only speaks versions we don't know can't use our frames.
+		// Browsers hide the HTTP status, so reject explains it in a close frame.
+		if offered := websocket.Subprotocols(r); !offersKnownSubprotocol(offered) {
+			slog.Warn("client rejected, unsupported subprotocols", "remote", r.RemoteAddr, "offered", offered)
+			reject(w, r, http.StatusBadRequest, websocket.CloseProtocolError,
+				"unsupported subprotocol, supported: "+strings.Join(subprotocolNames(), ", "))
+			return
+		}
+
+		// Refuse early, before setting up a client we won't keep.
+		if hub.Full() {
+			slog.Warn("client rejected, limit reached", "remote", r.RemoteAddr)
+			reject(w, r, http.StatusServiceUnavailable, websocket.CloseTryAgainLater, "too many clients")
+			return
+		}
+
+		// Upgrade the initial HTTP connection to a persistent WebSocket connection.
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// A genuine handshake went wrong (bad origin, missing key, unsupported
+			// version). The upgrader has already replied with an HTTP error.
+			slog.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+
+		// Compress outgoing data frames. This is a no-op unless compression was
+		// negotiated in the handshake (needs -compress and a supporting client).
+		if upgrader.EnableCompression {
+			ws.EnableWriteCompression(true)
+		}
+
+		// Without a limit a single huge frame is read into memory in full.
+		// Larger messages make ReadMessage fail, gorilla then closes the
+		// connection with 1009 (message too big).
+		if opts.MaxMessageSize > 0 {
+			ws.SetReadLimit(opts.MaxMessageSize)
 		}
-		// Unlock the mutex after we're done with the `clients` map.
-		mutex.Unlock()
+
+		// --- Register New Client ---
+		client := newClient(ws, opts.MaxHz)
+		client.since = resumeFrom(r)
+		client.room = roomName
+		// The negotiated subprotocol, "" for none, picks the starting format.
+		client.protocol = ws.Subprotocol()
+		client.format.Store(int32(subprotocolFormat(client.protocol)))
+		client.identity = requestIdentity(r)
+		// The request context ends with the gateway (see BaseContext in main).
+		serveClient(r.Context(), hub, client, opts)
+	}
+}
+
+// serveClient registers a new client with the hub and serves it until it goes
+// away, or rejects it with a close frame if it can't be registered. It is the
+// part of handling a connection that WebSocket and TCP clients (see tcp.go) share.
+func serveClient(ctx context.Context, hub *Hub, client *Client, opts EndpointOptions) {
+	client.untracked = hub.opts.Untracked
+	displaced, err := hub.Register(client)
+	if displaced != nil {
+		displaced.log.Info("client replaced by a new session", "identity", displaced.identity, "by", client.id)
+		go displaced.displace()
+	}
+	switch {
+	case errors.Is(err, errSessionActive):
+		writeClose(client.conn, websocket.ClosePolicyViolation, err.Error())
+		client.conn.Close()
+		client.log.Warn("client rejected, session already active", "identity", client.identity)
+		return
+	case err != nil:
+		// Another client took the last slot between the caller's check and now.
+		writeClose(client.conn, websocket.CloseTryAgainLater, "too many clients")
+		client.conn.Close()
+		client.log.Warn("client rejected, limit reached")
+		return
 	}
-}
\ No newline at end of file
+	client.log.Info("client connected", "identity", client.identity, "protocol", client.protocol, "room", client.room, "since", client.since, "resumed", client.resumed)
+	if !client.untracked {
+		clientConnects.Inc()
+		clientsConnected.Inc()
+	}
+	// Ensure the client is removed when the function returns. That closes its
+	// send queue, which stops the writer goroutine and closes the connection.
+	// SYNTAX: deferred calls run in reverse order, so the log line comes after Unregister.
+	defer func() {
+		reason := client.disconnectReason()
+		client.log.Info("client disconnected", "reason", reason, "dropped", client.Dropped())
+		if !client.untracked {
+			clientDisconnects.WithLabelValues(reason).Inc()
+			clientsConnected.Dec()
+		}
+	}()
+	defer hub.Unregister(client)
+
+	// The writer goroutine delivers everything Hub.Run queues for this client.
+	go client.writePump(ctx, opts)
+
+	// --- Read Loop ---
+	// Delivery happens in writePump, this goroutine forwards the client's commands
+	// and notices when the client goes away.
+	client.readPump(hub, opts)
+}
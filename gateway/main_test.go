@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestMain keeps the gateway's logging out of the test output.
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// startHub returns a running hub that is stopped when the test ends.
+func startHub(t testing.TB, opts HubOptions) *Hub {
+	t.Helper()
+	if opts.QueueSize == 0 {
+		opts.QueueSize = 256
+	}
+	hub := NewHub(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hub.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return hub
+}
+
+// countingListener counts the bytes the server writes to its connections.
+type countingListener struct {
+	net.Listener
+	written *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, written: l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// startServer serves `hub` at "/ws" with `opts`. written, if not nil, counts
+// the bytes the server sends.
+func startServer(t testing.TB, hub *Hub, opts EndpointOptions, written *atomic.Int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handleConnections(hub, opts))
+	if written != nil {
+		srv.Listener = countingListener{Listener: srv.Listener, written: written}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// wsURL returns the WebSocket URL of srv's "/ws".
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// waitFor fails the test if cond doesn't become true within a few seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// counterValue returns the current value of a Prometheus counter.
+func counterValue(t testing.TB, counter prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// setCompression sets -compress for the duration of the test.
+func setCompression(t testing.TB, on bool) {
+	old := upgrader.EnableCompression
+	upgrader.EnableCompression = on
+	t.Cleanup(func() { upgrader.EnableCompression = old })
+}
+
+// telemetry is a typical JSON frame of 20 robots.
+var telemetry = func() []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"robots":[`)
+	for i := range 20 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`{"id":"robot_` + strconv.Itoa(i) + `","x":12.345678,"y":-3.210987,"heading":1.5707963,"battery":87.5}`)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}()
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		name := "off"
+		if on {
+			name = "on"
+		}
+		t.Run(name, func(t *testing.T) {
+			setCompression(t, on)
+			hub := startHub(t, HubOptions{})
+			srv := startServer(t, hub, EndpointOptions{}, nil)
+
+			dialer := websocket.Dialer{EnableCompression: true}
+			conn, resp, err := dialer.Dial(wsURL(srv), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			negotiated := strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+			if negotiated != on {
+				t.Fatalf("permessage-deflate negotiated = %v, want %v", negotiated, on)
+			}
+			waitFor(t, "the client to register", func() bool { return hub.Count() == 1 })
+
+			// Binary payloads aren't valid UTF-8 and must arrive byte for byte.
+			binary := make([]byte, 4096)
+			for i := range binary {
+				binary[i] = byte(i*31 + i/7)
+			}
+			sent := []Message{
+				{Type: websocket.BinaryMessage, Data: binary},
+				{Type: websocket.TextMessage, Data: telemetry},
+			}
+			for _, msg := range sent {
+				hub.Broadcast(msg)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for _, want := range sent {
+				msgType, data, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msgType != want.Type || !bytes.Equal(data, want.Data) {
+					t.Fatalf("got a type %d frame of %d bytes, want type %d with the %d bytes sent", msgType, len(data), want.Type, len(want.Data))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompressionBytesOnWire reports the bytes the server writes per
+// telemetry frame, with and without -compress.
+func BenchmarkCompressionBytesOnWire(b *testing.B) {
+	for _, on := range []bool{false, true} {
+		name := "off"
+		if on {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			setCompression(b, on)
+			hub := startHub(b, HubOptions{})
+			var written atomic.Int64
+			srv := startServer(b, hub, EndpointOptions{}, &written)
+			conn, _, err := (&websocket.Dialer{EnableCompression: true}).Dial(wsURL(srv), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			waitFor(b, "the client to register", func() bool { return hub.Count() == 1 })
+
+			// The handshake doesn't count.
+			start := written.Load()
+			b.ResetTimer()
+			for range b.N {
+				hub.Broadcast(Message{Type: websocket.TextMessage, Data: telemetry})
+				if _, _, err := conn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(written.Load()-start)/float64(b.N), "wire-B/frame")
+			b.ReportMetric(float64(len(telemetry)), "payload-B/frame")
+		})
+	}
+}
+
+// Every client runs a reader and a writer goroutine. Whichever way a client
+// leaves, both have to end, or a busy gateway slowly runs out of memory.
+func TestClientGoroutinesEnd(t *testing.T) {
+	hub := startHub(t, HubOptions{})
+	srv := startServer(t, hub, EndpointOptions{}, nil)
+	baseline := runtime.NumGoroutine()
+
+	for i := range 1000 {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv), nil)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if i%2 == 0 {
+			// A clean close, the server's ReadMessage sees the close frame.
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+		} else {
+			// A dropped connection, the server's ReadMessage fails instead.
+			conn.NetConn().Close()
+		}
+	}
+
+	waitFor(t, "every client to unregister", func() bool { return hub.Count() == 0 })
+	waitFor(t, "the client goroutines to end", func() bool { return runtime.NumGoroutine() <= baseline })
+}
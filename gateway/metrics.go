@@ -0,0 +1,162 @@
+package main
+
+import (
+	"time" // For latency calculations
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// --- Prometheus Metrics ---
+// These are scraped from the "/metrics" endpoint of the admin server (see admin.go).
+// `promauto` registers every metric with the default registry as it is created,
+// so declaring the variable is all that's needed to expose it.
+
+var (
+	udpPacketsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_packets_received_total",
+		Help: "UDP packets received from the simulation.",
+	})
+	udpBytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_bytes_received_total",
+		Help: "Payload bytes received from the simulation over UDP.",
+	})
+	udpPacketsMalformed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_packets_malformed_total",
+		Help: "UDP packets that could not be decoded as robot state (forwarded anyway unless -strict).",
+	})
+	udpPacketsShed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_packets_shed_total",
+		Help: "UDP packets dropped on arrival because they exceeded -udp-max-pps or -udp-max-bps.",
+	})
+	udpPacketsBlocked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_packets_blocked_total",
+		Help: "UDP packets dropped because their sender isn't in -udp-allow.",
+	})
+	udpPacketsInsane = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_packets_insane_total",
+		Help: "UDP packets dropped by -sanitize because of NaN or infinite values that can't be clamped.",
+	})
+	valuesClamped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_values_clamped_total",
+		Help: "Robot coordinates clamped into range by -sanitize.",
+	})
+	udpPacketsMissing = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_udp_packets_missing_total",
+		Help: "UDP packets detected as lost from gaps in the sequence number. Loss rate = missing / (missing + received).",
+	})
+	broadcastQueueDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_broadcast_queue_dropped_total",
+		Help: "Messages dropped because the hub's broadcast queue was full (for longer than -queue-retry).",
+	})
+	slowConsumerWarnings = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_slow_consumer_warnings_total",
+		Help: "Warnings about clients whose send queue stayed over -slow-fill for -slow-after.",
+	})
+	// SYNTAX: a CounterVec is a family of counters told apart by label values, here one per goroutine.
+	panicsRecovered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_panics_recovered_total",
+		Help: "Panics recovered in the broadcaster and UDP readers, which were then restarted, and in client goroutines, whose client was dropped (-recover-panics).",
+	}, []string{"goroutine"})
+	commandsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_commands_rejected_total",
+		Help: "Client commands not forwarded because they failed -validate-commands.",
+	})
+	messagesCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_coalesced_total",
+		Help: "Messages written to a client as part of a batch frame (-coalesce), rather than in a frame of their own.",
+	})
+	broadcastQueueAbsorbed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_broadcast_queue_absorbed_total",
+		Help: "Messages that found the broadcast queue full but got in within -queue-retry.",
+	})
+	messagesBroadcast = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_broadcast_total",
+		Help: "Messages fanned out by the hub (counted once per message, not per client).",
+	})
+	messagesDeduped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_deduped_total",
+		Help: "Messages not broadcast because they repeated the previous payload of the same robot (-dedup).",
+	})
+	messagesUnchanged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_unchanged_total",
+		Help: "Robot states not broadcast because the robot's pose didn't change (-delta).",
+	})
+	messagesSampledOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_sampled_out_total",
+		Help: "Packets only cached, not broadcast, because -sample left them out.",
+	})
+	messagesRoomLimit = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_room_limit_total",
+		Help: "Messages dropped because they named a new room beyond -max-rooms.",
+	})
+	messagesPaused = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_messages_paused_total",
+		Help: "Messages not forwarded because ingest was paused on the admin server.",
+	})
+	framesReencoded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_frames_reencoded_total",
+		Help: "Robot states encoded in a format a client asked for (see format.go), by format. At most once per broadcast and format.",
+	}, []string{"format"})
+	clientConnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_client_connects_total",
+		Help: "WebSocket clients that connected.",
+	})
+	clientDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_client_disconnects_total",
+		Help: "WebSocket clients that disconnected, by reason (see disconnect.go).",
+	}, []string{"reason"})
+	clientsConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_clients_connected",
+		Help: "WebSocket clients currently connected.",
+	})
+	streamHealthyGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gateway_stream_healthy",
+		Help: "1 while simulation data arrives, 0 once none has for -silence-timeout (see silence.go).",
+	}, func() float64 {
+		if streamHealthy() {
+			return 1
+		}
+		return 0
+	})
+
+	// Together the two latencies tell whether lag comes from the network or the gateway.
+	udpTransit = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gateway_udp_transit_seconds",
+		Help:    "Time from the robot state's timestamp to its arrival at the gateway. Only meaningful with synchronized clocks.",
+		Buckets: latencyBuckets,
+	})
+	deliveryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gateway_delivery_latency_seconds",
+		Help:    "Time from receiving a packet to writing it to a WebSocket client, observed once per client.",
+		Buckets: latencyBuckets,
+	})
+)
+
+// latencyBuckets go from 100µs to about 6.5s, each 4 times the previous one.
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 4, 9)
+
+// observeTransit records the transit time of a packet stamped `sentMillis`
+// (Unix milliseconds) that arrived at `received`.
+func observeTransit(received time.Time, sentMillis int64) {
+	transit := received.Sub(time.UnixMilli(sentMillis))
+	// A negative transit means the clocks disagree, it would only distort the histogram.
+	if transit >= 0 {
+		udpTransit.Observe(transit.Seconds())
+	}
+}
+
+// registerHubMetrics exposes gauges that are read from `hub` at scrape time.
+// It must be called at most once, registering the same metric twice panics.
+func registerHubMetrics(hub *Hub) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gateway_broadcast_queue_depth",
+		Help: "Messages currently waiting in the hub's broadcast queue.",
+	}, func() float64 {
+		return float64(hub.QueueLen())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gateway_broadcast_rate_hz",
+		Help: "Messages broadcast per second, averaged over the last 10 seconds. 0 means the simulation is silent.",
+	}, hub.Rate)
+}
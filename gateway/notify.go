@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json" // For checking the body
+	"io"            // For reading the body
+	"net/http"      // For the handler
+	"strconv"       // For parsing the client id
+
+	"github.com/gorilla/websocket"
+)
+
+// maxNotifyBody is the largest body "/notify" accepts, notes between operators are short.
+const maxNotifyBody = 64 << 10
+
+// handleNotify returns the handler for "POST /notify?client=<id>" on the admin
+// server. It delivers the JSON body to that one connection (the id is in the
+// gateway's logs and in the -require-hello greeting), e.g. to point an operator
+// at a robot to follow. With -envelope the body arrives as {"type":"notify","payload":...}.
+// It answers 404 if no such client is connected and 503 if its queue is full.
+func handleNotify(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("client"), 10, 64)
+		if err != nil {
+			http.Error(w, "missing or invalid client id", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNotifyBody))
+		if err != nil {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Browsers parse whatever arrives as JSON, don't hand them something that breaks that.
+		if !json.Valid(body) {
+			http.Error(w, "body must be JSON", http.StatusBadRequest)
+			return
+		}
+
+		client := hub.Lookup(id)
+		if client == nil {
+			http.Error(w, "client not connected", http.StatusNotFound)
+			return
+		}
+		if hub.opts.Envelope {
+			body = wrapEnvelope(typeNotify, body)
+		}
+		// Send fails if the client went away since Lookup or can't keep up.
+		if !hub.Send(client, Message{Type: websocket.TextMessage, Data: body}) {
+			http.Error(w, "client not accepting messages", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
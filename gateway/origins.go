@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http" // For reading the request's Origin header
+	"strings"  // For splitting and normalizing the flag value
+)
+
+// originSet is the set of browser origins allowed to open a WebSocket,
+// parsed from the -allowed-origins flag. The entry "*" allows every origin.
+type originSet map[string]bool
+
+// parseOrigins turns a comma-separated list like
+// "http://localhost:5173, https://dashboard.example.com" into an originSet.
+// Origins are compared case-insensitively and without a trailing slash.
+func parseOrigins(list string) originSet {
+	set := make(originSet)
+	for _, origin := range strings.Split(list, ",") {
+		origin = normalizeOrigin(origin)
+		if origin != "" {
+			set[origin] = true
+		}
+	}
+	return set
+}
+
+// normalizeOrigin makes "HTTP://Localhost:5173/ " and "http://localhost:5173" compare equal.
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+// allow is used as the upgrader's CheckOrigin.
+// Requests without an Origin header don't come from a browser page (CLI tools,
+// other services), and the same-origin policy doesn't apply to them, so they pass.
+func (s originSet) allow(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s["*"] {
+		return true
+	}
+	return s[normalizeOrigin(origin)]
+}
+
+// listed is like allow, but "*" doesn't count: the origin has to be on the
+// list by name. Requests without an Origin header still pass.
+func (s originSet) listed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || s[normalizeOrigin(origin)]
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginSetAllow(t *testing.T) {
+	tests := []struct {
+		name   string
+		list   string
+		origin string
+		want   bool
+	}{
+		{"listed origin", "http://localhost:5173,https://dashboard.example.com", "https://dashboard.example.com", true},
+		{"listed origin, other case and trailing slash", "http://localhost:5173", "HTTP://Localhost:5173/", true},
+		{"spaces around entries", " http://localhost:5173 , https://a.example ", "https://a.example", true},
+		{"unlisted origin", "http://localhost:5173", "https://evil.example", false},
+		{"other port", "http://localhost:5173", "http://localhost:8080", false},
+		{"other scheme", "http://localhost:5173", "https://localhost:5173", false},
+		{"no Origin header", "http://localhost:5173", "", true},
+		{"wildcard", "*", "https://anything.example", true},
+		{"wildcard among others", "http://localhost:5173,*", "https://anything.example", true},
+		{"empty list", "", "http://localhost:5173", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := parseOrigins(tt.list).allow(r); got != tt.want {
+				t.Errorf("parseOrigins(%q).allow(Origin: %q) = %v, want %v", tt.list, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"   // For comparing payloads when deduplicating
+	"fmt"     // For describing invalid pipelines
+	"slices"  // For checking stage names
+	"strings" // For splitting the -pipeline flag
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Transform Pipeline ---
+// Before a broadcast reaches the clients of a room, it runs through a chain of
+// stages, one per feature. -pipeline sets their order, a feature that is
+// turned off (or left out of -pipeline) is simply not part of the chain.
+// Adding a feature means writing one more stage instead of another special
+// case in Hub.deliver. There are two kinds:
+//
+//   - Shared stages run once per message and room and rewrite the payload
+//     every client gets: "dedup" (-dedup), "delta" (-delta) and "envelope"
+//     (-envelope). Each one gets the payload of the previous one and can
+//     rewrite it or drop the message.
+//   - Per-client stages run for every client of the room and decide whether
+//     that client gets the message: "filter" (the client's subscription and
+//     field filter, see filter.go) and "decimate" (the client's rate, see
+//     decimate.go). Clients opt into them, so they are on unless left out.
+//
+// The per-client stages see the message after dedup and delta, but look at the
+// state as it was received, so running them before the envelope is the same
+// as running them after it.
+
+// Transform is a shared stage of the pipeline. It returns the payload to hand
+// to the next stage and whether to keep the message at all.
+type Transform func(data []byte) ([]byte, bool)
+
+// ClientTransform is a per-client stage. It returns whether to go on with msg
+// for c: false drops it for this client only (or holds it back, see
+// Hub.decimate). `fields` is the received state, for filters.
+type ClientTransform func(c *Client, msg Message, fields *stateFields) bool
+
+// defaultPipeline is the order the stages run in unless -pipeline says otherwise.
+const defaultPipeline = "dedup,delta,filter,decimate,envelope"
+
+// pipelineStages are the names -pipeline accepts, clientStages the per-client ones among them.
+var (
+	pipelineStages = []string{"dedup", "delta", "filter", "decimate", "envelope"}
+	clientStages   = []string{"filter", "decimate"}
+)
+
+// parsePipeline parses a comma-separated list of stages, e.g.
+// "delta,dedup,filter,decimate,envelope". Every stage may appear once.
+// "envelope" has to come last: dedup and delta compare robot states, which
+// they can't find inside an envelope. The shared dedup and delta come before
+// the per-client stages, which run for every client once they are done.
+// "decimate" is the last per-client stage, it hands messages over later.
+func parsePipeline(spec string) ([]string, error) {
+	var stages []string
+	for name := range strings.SplitSeq(spec, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			continue
+		case !slices.Contains(pipelineStages, name):
+			return nil, fmt.Errorf("unknown stage %q, known: %s", name, strings.Join(pipelineStages, ", "))
+		case slices.Contains(stages, name):
+			return nil, fmt.Errorf("stage %q appears twice", name)
+		case slices.Contains(stages, "envelope"):
+			return nil, fmt.Errorf("%q comes after envelope, which has to be last", name)
+		case slices.Contains(stages, "decimate") && name != "envelope":
+			return nil, fmt.Errorf("%q comes after decimate, the last per-client stage", name)
+		case slices.Contains(stages, "filter") && !slices.Contains(clientStages, name) && name != "envelope":
+			return nil, fmt.Errorf("%q comes after filter, shared stages run before the per-client ones", name)
+		}
+		stages = append(stages, name)
+	}
+	return stages, nil
+}
+
+// pipeline is a chain of shared stages, run in order.
+type pipeline []Transform
+
+// run passes data through every stage, stopping at the first that drops it.
+func (p pipeline) run(data []byte) ([]byte, bool) {
+	for _, transform := range p {
+		var keep bool
+		if data, keep = transform(data); !keep {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// clientPipeline is a chain of per-client stages, run in order.
+type clientPipeline []ClientTransform
+
+// run reports whether msg reaches c, stopping at the first stage that drops it.
+func (p clientPipeline) run(c *Client, msg Message, fields *stateFields) bool {
+	for _, transform := range p {
+		if !transform(c, msg, fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// newClientPipeline builds the per-client stages, in the order of
+// HubOptions.Pipeline. They keep their state in the clients, so all rooms share them.
+func (h *Hub) newClientPipeline() clientPipeline {
+	var p clientPipeline
+	for _, name := range h.opts.Pipeline {
+		switch name {
+		case "filter":
+			p = append(p, h.filterStage)
+		case "decimate":
+			p = append(p, h.decimate)
+		}
+	}
+	return p
+}
+
+// newPipeline builds the shared stages of r from the enabled ones, in the order
+// of HubOptions.Pipeline. The stages keep their state in the room, so every
+// room deduplicates on its own. The caller must hold the mutex.
+func (h *Hub) newPipeline(r *room) pipeline {
+	var p pipeline
+	for _, name := range h.opts.Pipeline {
+		// SYNTAX: `r.dedup` is a method value, a Transform bound to r.
+		switch {
+		case name == "dedup" && h.opts.Dedup:
+			p = append(p, r.dedup)
+		case name == "delta" && h.opts.Delta:
+			p = append(p, r.deltaStage)
+		case name == "envelope" && h.opts.Envelope:
+			p = append(p, r.envelope)
+		}
+	}
+	return p
+}
+
+// The stages below need a little more than the payload (the robot ID, the
+// decoded state, the sequence number): they read it from r.current, the message deliver is
+// running through the pipeline.
+
+// dedup drops a payload identical to the previous one about the same robot.
+func (r *room) dedup(data []byte) ([]byte, bool) {
+	id := r.current.RobotID
+	duplicate := bytes.Equal(r.seen[id], data)
+	r.seen[id] = data
+	if duplicate {
+		messagesDeduped.Inc()
+	}
+	return data, !duplicate
+}
+
+// deltaStage drops robot states whose pose didn't change, see delta.go.
+func (r *room) deltaStage(data []byte) ([]byte, bool) {
+	if !r.delta.changed(r.current.State, data) {
+		messagesUnchanged.Inc()
+		return data, false
+	}
+	return data, true
+}
+
+// filterStage drops messages about robots c didn't subscribe to or that don't pass its field filter.
+func (h *Hub) filterStage(c *Client, msg Message, fields *stateFields) bool {
+	return c.accepts(msg.RobotID, fields)
+}
+
+// envelope wraps text payloads as {"type":"state","payload":...,"seq":N}.
+// Binary frames aren't JSON and stay as they are.
+func (r *room) envelope(data []byte) ([]byte, bool) {
+	if r.current.Type != websocket.TextMessage {
+		return data, true
+	}
+	return wrapState(data, r.current.Seq), true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParsePipeline(t *testing.T) {
+	valid := []string{
+		defaultPipeline,
+		"delta,dedup,filter,decimate,envelope",
+		"dedup,delta",
+		"filter,decimate",
+		"decimate,envelope",
+		"",
+	}
+	for _, spec := range valid {
+		if _, err := parsePipeline(spec); err != nil {
+			t.Errorf("parsePipeline(%q): %v", spec, err)
+		}
+	}
+	invalid := []string{
+		"dedup,bogus",
+		"dedup,dedup",
+		"envelope,dedup",
+		"filter,delta",   // shared stages come first
+		"decimate,dedup", // decimate is the last per-client one
+		"decimate,filter",
+	}
+	for _, spec := range invalid {
+		if stages, err := parsePipeline(spec); err == nil {
+			t.Errorf("parsePipeline(%q) = %v, want an error", spec, stages)
+		}
+	}
+}
+
+// state is a JSON robot state with a battery level, decoded like the UDP server does.
+func state(t *testing.T, id string, x, battery float64) Message {
+	t.Helper()
+	data := []byte(`{"id":"` + id + `","x":` + strconv.FormatFloat(x, 'g', -1, 64) + `,"y":0,"battery":` + strconv.FormatFloat(battery, 'g', -1, 64) + `}`)
+	decoded, err := (jsonCodec{}).Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Message{Type: websocket.TextMessage, Data: data, RobotID: id, State: &decoded}
+}
+
+// lowBattery sets the filter of c to robots below 20% battery.
+func lowBattery(t *testing.T, c *Client) {
+	t.Helper()
+	f, err := compileFilter([]condition{{Field: "battery", Op: "<", Value: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.filter.Store(&f)
+}
+
+// queued takes everything out of c's queue.
+func queued(c *Client) []Message {
+	var msgs []Message
+	for len(c.send) > 0 {
+		msgs = append(msgs, <-c.send)
+	}
+	return msgs
+}
+
+// Keyframes are sent outside of the broadcasts, they have to apply the filter themselves.
+func TestKeyframeRespectsClientFilters(t *testing.T) {
+	hub := NewHub(HubOptions{QueueSize: 16, Delta: true})
+	filtered := register(t, hub, newFakeConn())
+	lowBattery(t, filtered)
+	everyone := register(t, hub, newFakeConn())
+
+	hub.deliver(state(t, "robot_low", 1, 10))
+	hub.deliver(state(t, "robot_full", 1, 90))
+	if got := queued(filtered); len(got) != 1 || got[0].RobotID != "robot_low" {
+		t.Fatalf("filtered client got %d broadcasts, want only robot_low's", len(got))
+	}
+	queued(everyone)
+
+	hub.keyframe()
+	frames := queued(filtered)
+	if len(frames) != 1 {
+		t.Fatalf("filtered client got %d frames, want one keyframe", len(frames))
+	}
+	if kf := frames[0].Data; !bytes.Contains(kf, []byte("robot_low")) || bytes.Contains(kf, []byte("robot_full")) {
+		t.Errorf("filtered client's keyframe = %s, want only robot_low", kf)
+	}
+	frames = queued(everyone)
+	if len(frames) != 1 || !bytes.Contains(frames[0].Data, []byte("robot_low")) || !bytes.Contains(frames[0].Data, []byte("robot_full")) {
+		t.Errorf("unfiltered client's keyframes = %v, want one with both robots", frames)
+	}
+}
+
+func TestDecimateStage(t *testing.T) {
+	hub := NewHub(HubOptions{QueueSize: 16})
+	const hz = 20
+	slow := newClient(newFakeConn(), hz)
+	if _, err := hub.Register(slow); err != nil {
+		t.Fatal(err)
+	}
+	fast := register(t, hub, newFakeConn())
+
+	for i := range 5 {
+		hub.deliver(state(t, "robot_1", float64(i), 50))
+	}
+	if n := len(queued(fast)); n != 5 {
+		t.Errorf("client without a rate got %d of 5 broadcasts", n)
+	}
+	// The first one is due right away, the others wait for the end of the interval.
+	first := queued(slow)
+	if len(first) != 1 || first[0].State.X != 0 {
+		t.Fatalf("decimated client got %d messages right away, want the first one", len(first))
+	}
+	waitFor(t, "the held back state", func() bool { return len(slow.send) > 0 })
+	if rest := queued(slow); len(rest) != 1 || rest[0].State.X != 4 {
+		t.Errorf("decimated client got %d messages after the interval, want only the newest (x 4)", len(rest))
+	}
+
+	// A pipeline without "decimate" ignores the rate.
+	stages, _ := parsePipeline("filter")
+	plain := NewHub(HubOptions{QueueSize: 16, Pipeline: stages})
+	client := newClient(newFakeConn(), hz)
+	if _, err := plain.Register(client); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		plain.deliver(state(t, "robot_1", float64(i), 50))
+	}
+	if n := len(queued(client)); n != 3 {
+		t.Errorf("without the decimate stage the client got %d of 3 broadcasts", n)
+	}
+}
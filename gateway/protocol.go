@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"         // For a cheap "does this look like JSON" check
+	"encoding/json" // For decoding control messages
+	"time"          // For heartbeat timestamps
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Client -> Gateway Control Messages ---
+// Most messages a client sends are operator commands meant for the simulation.
+// A few, recognized by their keys, are instructions for the gateway itself
+// and are handled here instead of being forwarded.
+
+// controlMessage lists every key the gateway understands.
+// Fields are pointers so we can tell "not present" from "present but empty".
+type controlMessage struct {
+	// Subscribe limits the stream to the given robot IDs, e.g. {"subscribe":["robot-3","robot-7"]}.
+	// An empty list subscribes to everything again.
+	Subscribe *[]string `json:"subscribe"`
+
+	// MaxHz asks for at most this many updates per second, e.g. {"maxHz":5} for a
+	// phone that can't draw faster anyway. 0 goes back to the endpoint's default rate.
+	MaxHz *float64 `json:"maxHz"`
+
+	// Hello answers the gateway's hello with {"hello":true}. With -require-hello
+	// a client gets no broadcasts before it has done so, see HubOptions.RequireHello.
+	Hello *bool `json:"hello"`
+
+	// Format picks the frames robot states arrive in, {"format":"text"} (JSON)
+	// or {"format":"binary"} (protobuf), see format.go.
+	Format *string `json:"format"`
+
+	// Filter only lets robot states through that match all conditions, see filter.go.
+	Filter *[]condition `json:"filter"`
+
+	// Room moves the client to another room, e.g. {"room":"swarm-a"}, see room.go.
+	// "" is the default room.
+	Room *string `json:"room"`
+
+	// Pause stops the stream without disconnecting, e.g. {"pause":true} from a
+	// tab in the background, {"pause":false} resumes it, see Hub.Pause.
+	Pause *bool `json:"pause"`
+}
+
+// parseControl decodes msg as a control message. It returns false if msg is
+// not a JSON object or contains none of the control keys, i.e. it is a command.
+func parseControl(msg []byte) (controlMessage, bool) {
+	var ctrl controlMessage
+	// Skip the JSON decoder for payloads that can't be an object,
+	// commands in other formats never pay for it.
+	if !bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		return ctrl, false
+	}
+	if err := json.Unmarshal(msg, &ctrl); err != nil {
+		return ctrl, false
+	}
+	return ctrl, ctrl.Subscribe != nil || ctrl.MaxHz != nil || ctrl.Hello != nil || ctrl.Format != nil || ctrl.Filter != nil || ctrl.Room != nil || ctrl.Pause != nil
+}
+
+// injectField adds "key": value as the first field of a JSON object payload,
+// e.g. injectField({"id":"r1"}, "shard", 8001) is {"shard":8001,"id":"r1"}.
+// Payloads that aren't a JSON object are returned unchanged.
+// The result is a new slice, `payload` itself is not modified.
+func injectField(payload []byte, key string, value any) []byte {
+	body := bytes.TrimSpace(payload)
+	if len(body) < 2 || body[0] != '{' {
+		return payload
+	}
+	field, err := json.Marshal(map[string]any{key: value})
+	if err != nil {
+		return payload
+	}
+	// `field` is {"key":value}. Drop its closing brace and continue with the
+	// original object's fields, adding a comma unless the object is empty.
+	rest := bytes.TrimSpace(body[1:])
+	out := make([]byte, 0, len(field)+len(rest)+1)
+	out = append(out, field[:len(field)-1]...)
+	if rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, rest...)
+}
+
+// --- Gateway -> Client Messages ---
+// Besides the robot states from the simulation, the gateway sends a few messages
+// of its own. They are JSON objects with a "type" key, which robot states don't have.
+// With -envelope, every message (robot states included) is wrapped as
+// {"type":...,"payload":...} instead, so the frontend never has to guess.
+
+// Message types, the value of the "type" key.
+const (
+	typeState     = "state"
+	typeHeartbeat = "heartbeat"
+	typeKeyframe  = "keyframe" // see delta.go
+	typeHello     = "hello"
+	typeAck       = "ack"    // see commands.go
+	typeNotify    = "notify" // see notify.go
+	typeError     = "error"
+	typeRestart   = "restart"
+)
+
+// envelope is the wrapper used with -envelope, e.g. {"type":"state","seq":42,"payload":{"id":"r1",...}}.
+type envelope struct {
+	Type string `json:"type"`
+	// Seq is the gateway's Message.Seq of a state, for resuming (see Client.since).
+	// Not to be confused with the simulation's RobotState.Seq inside the payload.
+	Seq uint64 `json:"seq,omitempty"`
+	// SYNTAX: json.RawMessage is embedded as is, without being decoded and encoded again.
+	Payload json.RawMessage `json:"payload"`
+}
+
+// wrapEnvelope wraps a JSON payload in an envelope of the given type.
+// Payloads that aren't valid JSON (e.g. binary robot states) can't be embedded
+// and are returned unchanged.
+func wrapEnvelope(kind string, payload []byte) []byte {
+	if !json.Valid(payload) {
+		return payload
+	}
+	data, err := json.Marshal(envelope{Type: kind, Payload: payload})
+	if err != nil {
+		return payload
+	}
+	return data
+}
+
+// wrapState wraps a robot state payload in an envelope carrying its sequence number.
+// Like wrapEnvelope it returns payloads that aren't valid JSON unchanged.
+func wrapState(payload []byte, seq uint64) []byte {
+	if !json.Valid(payload) {
+		return payload
+	}
+	data, err := json.Marshal(envelope{Type: typeState, Seq: seq, Payload: payload})
+	if err != nil {
+		return payload
+	}
+	return data
+}
+
+// heartbeatFrame is sent when no data has flowed for a while, e.g. {"type":"heartbeat","ts":1700000000000}.
+// In an envelope it becomes {"type":"heartbeat","payload":{"ts":1700000000000}}.
+type heartbeatFrame struct {
+	Type string `json:"type,omitempty"`
+	// TS is the gateway's clock in Unix milliseconds, like RobotState.Timestamp.
+	TS int64 `json:"ts"`
+}
+
+// heartbeatMessage builds the heartbeat frame for time `now`, wrapped if `wrap` is set.
+func heartbeatMessage(now time.Time, wrap bool) Message {
+	frame := heartbeatFrame{Type: typeHeartbeat, TS: now.UnixMilli()}
+	if wrap {
+		// The envelope carries the type, the payload doesn't repeat it.
+		frame.Type = ""
+	}
+	// Marshalling a struct of a string and an int can't fail.
+	data, _ := json.Marshal(frame)
+	if wrap {
+		data = wrapEnvelope(typeHeartbeat, data)
+	}
+	return Message{Type: websocket.TextMessage, Data: data}
+}
+
+// helloFrame is the first message of a connection with -require-hello, e.g. {"type":"hello","client":42}.
+// In an envelope it becomes {"type":"hello","payload":{"client":42}}.
+type helloFrame struct {
+	Type string `json:"type,omitempty"`
+	// Client is the connection's id, the one in the gateway's logs.
+	Client uint64 `json:"client"`
+}
+
+// helloMessage builds the hello frame for client `id`, wrapped if `wrap` is set.
+func helloMessage(id uint64, wrap bool) Message {
+	frame := helloFrame{Type: typeHello, Client: id}
+	if wrap {
+		frame.Type = ""
+	}
+	data, _ := json.Marshal(frame)
+	if wrap {
+		data = wrapEnvelope(typeHello, data)
+	}
+	return Message{Type: websocket.TextMessage, Data: data}
+}
+
+// errorFrame tells clients that the gateway drops input, e.g.
+// {"type":"error","detail":"malformed UDP packet: ...","count":3}, so a broken
+// ingest doesn't look like a simulation that stopped. Count is how many packets
+// were dropped since the previous error frame. A simulation that did stop gets
+// one with count 0, see silence.go.
+type errorFrame struct {
+	Type   string `json:"type,omitempty"`
+	Detail string `json:"detail"`
+	Count  int    `json:"count"`
+}
+
+// errorMessage builds an error frame, wrapped if `wrap` is set.
+func errorMessage(detail string, count int, wrap bool) Message {
+	frame := errorFrame{Type: typeError, Detail: detail, Count: count}
+	if wrap {
+		frame.Type = ""
+	}
+	data, _ := json.Marshal(frame)
+	if wrap {
+		data = wrapEnvelope(typeError, data)
+	}
+	return Message{Type: websocket.TextMessage, Data: data}
+}
+
+// restartFrame announces a shutdown with -close-grace, e.g.
+// {"type":"restart","detail":"server restarting","in":2000}. In is how many
+// milliseconds are left before the connection is closed with 1012, so a
+// frontend can pick a random moment to reconnect instead of all at once.
+type restartFrame struct {
+	Type   string `json:"type,omitempty"`
+	Detail string `json:"detail"`
+	In     int64  `json:"in"`
+}
+
+// restartMessage builds the restart frame for a close in `grace`, wrapped if `wrap` is set.
+func restartMessage(grace time.Duration, wrap bool) Message {
+	frame := restartFrame{Type: typeRestart, Detail: "server restarting", In: grace.Milliseconds()}
+	if wrap {
+		frame.Type = ""
+	}
+	data, _ := json.Marshal(frame)
+	if wrap {
+		data = wrapEnvelope(typeRestart, data)
+	}
+	return Message{Type: websocket.TextMessage, Data: data}
+}
+
+// --- Close Codes ---
+// When the gateway ends a connection, it says why in the close frame, so the
+// frontend can show the right message. The codes are the standard ones (RFC 6455
+// section 7.4.1 and the IANA registry), the reason is a short human readable text:
+//
+//	1001 going away       the gateway is shutting down
+//	1008 policy violation missing or wrong token ("unauthorized"),
+//	                      no message for -idle-timeout ("idle timeout"),
+//	                      -single-session ("session already active", "session replaced")
+//	1009 message too big  a message over -max-message-size (sent by gorilla)
+//	1011 internal error   serving the client panicked ("internal error"), see recoverClient
+//	1012 service restart  the gateway is shutting down with -close-grace
+//	1013 try again later  -max-clients reached ("too many clients")
+
+// writeClose sends a close frame. It doesn't close the connection, the caller
+// (or the writePump) does that. Errors are ignored, the connection is about to go anyway.
+// WriteControl may be called concurrently with the writePump's WriteMessage.
+func writeClose(conn Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync" // For guarding the buckets between Run and readers
+	"time" // For bucketing by second
+)
+
+// rateWindow is how many seconds rateMeter averages over. Long enough to smooth
+// out bursty senders, short enough to notice a stopped simulation quickly.
+const rateWindow = 10
+
+// rateMeter is a windowed counter: events are counted per second and rate
+// averages the last rateWindow complete seconds. It is safe for concurrent use.
+type rateMeter struct {
+	mutex sync.Mutex
+	// counts[i] belongs to the Unix second seconds[i], slot i is reused every rateWindow seconds.
+	counts  [rateWindow + 1]uint64
+	seconds [rateWindow + 1]int64
+}
+
+// add counts one event now.
+func (m *rateMeter) add() {
+	now := time.Now().Unix()
+	i := now % int64(len(m.counts))
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// A slot still holding an older second starts over.
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.counts[i] = 0
+	}
+	m.counts[i]++
+}
+
+// rate returns the average events per second over the last rateWindow seconds.
+// The current second is left out, it isn't over yet and would drag the average down.
+func (m *rateMeter) rate() float64 {
+	now := time.Now().Unix()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var total uint64
+	for i, second := range m.seconds {
+		if second < now && second >= now-rateWindow {
+			total += m.counts[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
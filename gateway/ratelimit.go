@@ -0,0 +1,38 @@
+package main
+
+import "time" // For measuring elapsed time between refills
+
+// tokenBucket is a classic token-bucket rate limiter. It holds up to `burst`
+// tokens and refills at `rate` tokens per second. Every allowed event takes one token.
+// It is not safe for concurrent use, each goroutine should own its own bucket.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // bucket capacity
+	tokens float64
+	last   time.Time // when tokens were last refilled
+}
+
+// newTokenBucket creates a full bucket, so a fresh client can send a burst right away.
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow reports whether an event may happen now and, if so, consumes a token.
+func (b *tokenBucket) allow() bool {
+	return b.allowN(1)
+}
+
+// allowN is allow for an event that costs n tokens, e.g. a packet of n bytes.
+func (b *tokenBucket) allowN(n float64) bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	// SYNTAX: `min` is a built-in function since Go 1.21.
+	b.tokens = min(b.tokens, b.burst)
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"           // For batching small writes into fewer syscalls
+	"compress/gzip"   // For compressed recordings
+	"encoding/binary" // For the fixed-size frame header
+	"errors"          // For the "already closed" error
+	"os"              // For the record file
+	"strings"         // For checking the file extension
+	"sync"            // For guarding the writer between the UDP loop and shutdown
+	"time"            // For frame timestamps
+)
+
+// --- Recording Format ---
+// A recording is a file starting with recordMagic, followed by one frame per packet:
+//
+//	offset  size  field
+//	0       8     nanoseconds since the recording started (big-endian uint64)
+//	8       4     payload length in bytes (big-endian uint32)
+//	12      n     payload, exactly as received over UDP
+//
+// There is no index or footer, a file cut short by a crash is still readable up to its last complete frame.
+//
+// Telemetry compresses well, so a path ending in ".gz" gets the same stream gzip
+// compressed. A compressed recording is only complete once the Recorder is closed,
+// after a crash it is readable up to roughly the last flushed block.
+
+// recordMagic identifies a recording file (and its format version).
+const recordMagic = "RSWARM1\n"
+
+// frameHeaderSize is the size of the timestamp and length fields in front of every payload.
+const frameHeaderSize = 12
+
+// errRecorderClosed is returned by Recorder.Write after Close.
+var errRecorderClosed = errors.New("recorder closed")
+
+// Recorder appends packets to a recording file.
+// It is safe for concurrent use.
+type Recorder struct {
+	mutex sync.Mutex
+	file  *os.File
+	// gz compresses between w and file, it is nil for uncompressed recordings.
+	gz    *gzip.Writer
+	w     *bufio.Writer
+	start time.Time
+}
+
+// NewRecorder creates (or truncates) the file at path and writes the header.
+// The recording is compressed if path ends in ".gz".
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{file: file, start: time.Now()}
+	if strings.HasSuffix(path, ".gz") {
+		r.gz = gzip.NewWriter(file)
+		r.w = bufio.NewWriter(r.gz)
+	} else {
+		r.w = bufio.NewWriter(file)
+	}
+	if _, err := r.w.WriteString(recordMagic); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write appends one packet, timestamped relative to the start of the recording.
+func (r *Recorder) Write(packet []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.w == nil {
+		return errRecorderClosed
+	}
+
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(time.Since(r.start)))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(packet)))
+	if _, err := r.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := r.w.Write(packet)
+	return err
+}
+
+// Close flushes buffered frames and closes the file. Later writes fail with errRecorderClosed.
+// For a compressed recording it also writes the gzip footer, without which the
+// file doesn't end as a valid gzip stream.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.w == nil {
+		return errRecorderClosed
+	}
+	// SYNTAX: errors.Join combines the errors (nil ones are dropped), so a failed
+	// flush doesn't hide a failed close and vice versa.
+	err := r.w.Flush()
+	if r.gz != nil {
+		err = errors.Join(err, r.gz.Close())
+	}
+	err = errors.Join(err, r.file.Close())
+	r.w = nil
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"           // For buffered reads of small frames
+	"bytes"           // For recognizing compressed files
+	"compress/gzip"   // For compressed recordings
+	"context"         // For stopping the replay
+	"encoding/binary" // For the fixed-size frame header
+	"errors"          // For recognizing the end of the file
+	"fmt"             // For error messages
+	"io"              // For io.ReadFull and io.EOF
+	"log/slog"        // For structured logging
+	"os"              // For the recording file
+	"time"            // For honoring the recorded timing
+)
+
+// ReplayOptions configures startReplay.
+type ReplayOptions struct {
+	// Speed multiplies the playback rate: 2 plays twice as fast, 0.5 at half speed.
+	Speed float64
+
+	// Loop starts over from the first frame when the end of the file is reached.
+	Loop bool
+}
+
+// gzipMagic are the first bytes of every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// recording is an open recording file, compressed or not.
+type recording struct {
+	file       *os.File
+	compressed bool
+}
+
+// openRecording opens a file written by Recorder and checks its header,
+// so a wrong path is reported at startup rather than from the replay goroutine.
+// Compressed recordings are recognized by their content, whatever their name.
+func openRecording(path string) (*recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, len(gzipMagic))
+	// A file shorter than that can't be a recording, frames() reports it below.
+	io.ReadFull(file, head)
+	rec := &recording{file: file, compressed: bytes.Equal(head, gzipMagic)}
+	if _, err := rec.frames(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+// frames (re)starts reading at the beginning of the recording and returns a
+// reader positioned at the first frame, right after the header.
+func (r *recording) frames() (*bufio.Reader, error) {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// SYNTAX: an interface variable can hold the file itself or a decompressor reading from it.
+	var src io.Reader = r.file
+	if r.compressed {
+		gz, err := gzip.NewReader(r.file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.file.Name(), err)
+		}
+		src = gz
+	}
+	reader := bufio.NewReader(src)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != recordMagic {
+		return nil, fmt.Errorf("%s is not a recording", r.file.Name())
+	}
+	return reader, nil
+}
+
+// readFrame reads the next frame of a recording. It returns io.EOF at a clean
+// end of file and io.ErrUnexpectedEOF if the last frame was cut short.
+// The recorder only writes UDP packets, so a length over maxUDPBuffer is a
+// corrupt header and an error, before a payload that size is allocated.
+func readFrame(r *bufio.Reader) (offset time.Duration, payload []byte, err error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	offset = time.Duration(binary.BigEndian.Uint64(header[0:8]))
+	size := binary.BigEndian.Uint32(header[8:12])
+	if size > maxUDPBuffer {
+		return 0, nil, fmt.Errorf("corrupt frame header, %d bytes is more than a UDP packet holds", size)
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		// A header without its payload is a truncated file, not a clean end.
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return offset, payload, nil
+}
+
+// startReplay plays a recording (opened with openRecording) into the hub as if
+// the packets arrived over UDP right now, keeping their original spacing.
+// It returns when the file is done (and Loop is off), can't be read, or ctx is canceled.
+func startReplay(ctx context.Context, rec *recording, hub *Hub, opts UDPOptions, replay ReplayOptions) {
+	file := rec.file
+	defer file.Close()
+
+	// A replay is a data source like the UDP listener, see health.go.
+	sourcesRunning.Add(1)
+	defer sourcesRunning.Add(-1)
+
+	// openRecording has just read the header, the first pass can't fail to start.
+	reader, _ := rec.frames()
+	for {
+		// Every pass starts its own clock and sequence numbering.
+		start := time.Now()
+		var seq seqTracker
+
+		for {
+			offset, payload, err := readFrame(reader)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				slog.Error("replay stopped, reading recording failed", "path", file.Name(), "err", err)
+				return
+			}
+
+			// Sleep until the frame's (scaled) point in time. Frames that are
+			// already late are sent right away, so a slow consumer catches up.
+			due := start.Add(time.Duration(float64(offset) / replay.Speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				return
+			}
+
+			countPacket(len(payload))
+			processPacket(payload, nil, hub, opts, &seq)
+		}
+
+		if !replay.Loop {
+			slog.Info("replay finished", "path", file.Name())
+			return
+		}
+		// Rewind to the first frame.
+		var err error
+		if reader, err = rec.frames(); err != nil {
+			slog.Error("replay stopped, rewinding recording failed", "path", file.Name(), "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// recordedFrame is a frame as the recorder writes it, with the length
+// prefix claiming `size` bytes.
+func recordedFrame(offset time.Duration, size uint32, payload []byte) []byte {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(header[8:12], size)
+	return append(header[:], payload...)
+}
+
+func TestReadFrame(t *testing.T) {
+	payload := frame(1)
+	tests := []struct {
+		name    string
+		file    []byte
+		wantErr error
+		// corrupt wants the header rejected, before the payload is read.
+		corrupt bool
+	}{
+		{name: "frame", file: recordedFrame(time.Second, uint32(len(payload)), payload)},
+		{name: "largest UDP packet", file: recordedFrame(0, maxUDPBuffer, make([]byte, maxUDPBuffer))},
+		{name: "end of file", file: nil, wantErr: io.EOF},
+		{name: "cut short", file: recordedFrame(0, 100, payload), wantErr: io.ErrUnexpectedEOF},
+		// Without the bound these allocate the claimed size before failing.
+		{name: "corrupt length", file: recordedFrame(0, 1<<32-1, payload), corrupt: true},
+		{name: "one over a UDP packet", file: recordedFrame(0, maxUDPBuffer+1, payload), corrupt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, got, err := readFrame(bufio.NewReader(bytes.NewReader(tt.file)))
+			switch {
+			case tt.corrupt:
+				if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("got %v, want the header rejected before reading the payload", err)
+				}
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.file[frameHeaderSize:]; !bytes.Equal(got, want) || offset != time.Duration(binary.BigEndian.Uint64(tt.file)) {
+				t.Errorf("got offset %v and %d bytes, want the %d bytes recorded", offset, len(got), len(want))
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"context" // For net.ListenConfig
+	"net"     // For the UDP socket
+	"syscall" // For the raw socket handed to Control
+
+	"golang.org/x/sys/unix" // For the SO_REUSEPORT socket option
+)
+
+// reusePortSupported reports whether listenReusePort can be used.
+const reusePortSupported = true
+
+// listenReusePort binds a UDP socket with SO_REUSEPORT, so several sockets can
+// share addr. Linux spreads the incoming packets over them by a hash of the
+// sender's address and port, so the packets of one sender all reach the same
+// socket, in order. See -udp-readers.
+func listenReusePort(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		// Control runs after the socket is created and before it is bound,
+		// the only moment the option can still be set.
+		Control: func(network, address string, raw syscall.RawConn) error {
+			var sockErr error
+			err := raw.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	// SYNTAX: a type assertion, ListenPacket returns a net.PacketConn interface.
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors" // For the unsupported error
+	"net"    // For the UDP socket
+)
+
+// reusePortSupported reports whether listenReusePort can be used. Other systems
+// have SO_REUSEPORT too, but don't spread the packets over the sockets.
+const reusePortSupported = false
+
+// listenReusePort always fails outside Linux, main refuses -udp-readers above 1 there.
+func listenReusePort(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT load balancing is only supported on Linux")
+}
@@ -0,0 +1,175 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: robotpb/robot_state.proto
+
+package robotpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// RobotState is the telemetry of one robot, the protobuf form of RobotState in
+// gateway/state.go. Field names match the JSON keys.
+type RobotState struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	X     float64                `protobuf:"fixed64,2,opt,name=x,proto3" json:"x,omitempty"`
+	Y     float64                `protobuf:"fixed64,3,opt,name=y,proto3" json:"y,omitempty"`
+	// Radians.
+	Heading float64 `protobuf:"fixed64,4,opt,name=heading,proto3" json:"heading,omitempty"`
+	// When the simulation produced the state, in Unix milliseconds.
+	Timestamp int64 `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Per-packet sequence number, wrapping around at 2^32.
+	Seq           *uint32 `protobuf:"varint,6,opt,name=seq,proto3,oneof" json:"seq,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RobotState) Reset() {
+	*x = RobotState{}
+	mi := &file_robotpb_robot_state_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RobotState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RobotState) ProtoMessage() {}
+
+func (x *RobotState) ProtoReflect() protoreflect.Message {
+	mi := &file_robotpb_robot_state_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RobotState.ProtoReflect.Descriptor instead.
+func (*RobotState) Descriptor() ([]byte, []int) {
+	return file_robotpb_robot_state_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RobotState) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *RobotState) GetX() float64 {
+	if x != nil {
+		return x.X
+	}
+	return 0
+}
+
+func (x *RobotState) GetY() float64 {
+	if x != nil {
+		return x.Y
+	}
+	return 0
+}
+
+func (x *RobotState) GetHeading() float64 {
+	if x != nil {
+		return x.Heading
+	}
+	return 0
+}
+
+func (x *RobotState) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *RobotState) GetSeq() uint32 {
+	if x != nil && x.Seq != nil {
+		return *x.Seq
+	}
+	return 0
+}
+
+var File_robotpb_robot_state_proto protoreflect.FileDescriptor
+
+const file_robotpb_robot_state_proto_rawDesc = "" +
+	"\n" +
+	"\x19robotpb/robot_state.proto\x12\frobots_swarm\"\x8f\x01\n" +
+	"\n" +
+	"RobotState\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\f\n" +
+	"\x01x\x18\x02 \x01(\x01R\x01x\x12\f\n" +
+	"\x01y\x18\x03 \x01(\x01R\x01y\x12\x18\n" +
+	"\aheading\x18\x04 \x01(\x01R\aheading\x12\x1c\n" +
+	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\x12\x15\n" +
+	"\x03seq\x18\x06 \x01(\rH\x00R\x03seq\x88\x01\x01B\x06\n" +
+	"\x04_seqB\x11Z\x0fgateway/robotpbb\x06proto3"
+
+var (
+	file_robotpb_robot_state_proto_rawDescOnce sync.Once
+	file_robotpb_robot_state_proto_rawDescData []byte
+)
+
+func file_robotpb_robot_state_proto_rawDescGZIP() []byte {
+	file_robotpb_robot_state_proto_rawDescOnce.Do(func() {
+		file_robotpb_robot_state_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_robotpb_robot_state_proto_rawDesc), len(file_robotpb_robot_state_proto_rawDesc)))
+	})
+	return file_robotpb_robot_state_proto_rawDescData
+}
+
+var file_robotpb_robot_state_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_robotpb_robot_state_proto_goTypes = []any{
+	(*RobotState)(nil), // 0: robots_swarm.RobotState
+}
+var file_robotpb_robot_state_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_robotpb_robot_state_proto_init() }
+func file_robotpb_robot_state_proto_init() {
+	if File_robotpb_robot_state_proto != nil {
+		return
+	}
+	file_robotpb_robot_state_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_robotpb_robot_state_proto_rawDesc), len(file_robotpb_robot_state_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_robotpb_robot_state_proto_goTypes,
+		DependencyIndexes: file_robotpb_robot_state_proto_depIdxs,
+		MessageInfos:      file_robotpb_robot_state_proto_msgTypes,
+	}.Build()
+	File_robotpb_robot_state_proto = out.File
+	file_robotpb_robot_state_proto_goTypes = nil
+	file_robotpb_robot_state_proto_depIdxs = nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"       // For looking up configured rooms
+	"unicode/utf8" // For validating room names
+)
+
+// --- Rooms ---
+// One gateway can serve several independent swarms. Every message belongs to
+// a room (Message.Room) and only reaches the clients in that room, which also
+// have their own snapshot, history, dedup and delta state, so robots with the
+// same ID in two swarms don't get mixed up.
+//
+// A packet's room is its "room" field, or else the room of the -udp-addr entry
+// it arrived on ("swarm-a=:8000"). Clients pick theirs with /ws?room=swarm-a
+// or switch later with {"room":"swarm-a"}. Whatever doesn't name a room is in
+// the default room, so a gateway with a single swarm works as before.
+// Packets can only create -max-rooms rooms beyond the -udp-addr ones, messages
+// for further rooms are dropped (gateway_messages_room_limit_total).
+
+// defaultRoom is the room of packets and clients that don't name one.
+const defaultRoom = ""
+
+// maxRoomNameLen bounds room names, they end up in logs and map keys.
+const maxRoomNameLen = 64
+
+// validRoomName reports whether name can be used as a room.
+func validRoomName(name string) bool {
+	return len(name) <= maxRoomNameLen && utf8.ValidString(name)
+}
+
+// room is the per-room part of the hub. It is guarded by the hub's mutex.
+type room struct {
+	// clients are the registered clients in this room.
+	clients map[*Client]bool
+
+	// last is the most recently broadcast message, see HubOptions.CacheLast.
+	last *Message
+
+	// seen is the previous payload of every robot, used for Dedup.
+	seen map[string][]byte
+
+	// delta decides which states are forwarded with Delta set, nil otherwise.
+	delta *deltaTracker
+
+	// history holds the recent messages with History set, nil otherwise.
+	history *history
+
+	// pipeline transforms every message broadcast to the room, see pipeline.go.
+	// current is the message it is running on, nil outside of Hub.deliver.
+	pipeline pipeline
+	current  *Message
+
+	// fed is set once a message was broadcast to the room. Rooms that never got
+	// one are removed again when their last client leaves, so clients can't
+	// pile up empty rooms with made-up names.
+	fed bool
+}
+
+// room returns the named room, creating it if needed. The caller must hold the mutex.
+func (h *Hub) room(name string) *room {
+	if r := h.rooms[name]; r != nil {
+		return r
+	}
+	r := &room{clients: make(map[*Client]bool), seen: make(map[string][]byte)}
+	if h.opts.Delta {
+		r.delta = newDeltaTracker()
+	}
+	if h.opts.History > 0 {
+		r.history = newHistory(h.opts.History, h.opts.HistoryMaxAge)
+	}
+	r.pipeline = h.newPipeline(r)
+	h.rooms[name] = r
+	return r
+}
+
+// admitRoom reports whether a message may be broadcast to the named room.
+// Fed rooms are never removed (see room.fed), so without a limit every made-up
+// name in a packet's "room" field would stay in memory for good. Rooms the
+// gateway was configured with are always admitted. The caller must hold the mutex.
+func (h *Hub) admitRoom(name string) bool {
+	if r := h.rooms[name]; r != nil && r.fed {
+		return true
+	}
+	if name == defaultRoom || slices.Contains(h.opts.Rooms, name) {
+		return true
+	}
+	if h.opts.MaxRooms > 0 && h.named >= h.opts.MaxRooms {
+		return false
+	}
+	h.named++
+	return true
+}
+
+// registered reports whether c is in the hub. The caller must hold the mutex.
+func (h *Hub) registered(c *Client) bool {
+	r := h.rooms[c.room]
+	return r != nil && r.clients[c]
+}
+
+// leave takes c out of its room, forgetting the room if it was never used.
+// The caller must hold the mutex and know that c is registered.
+func (h *Hub) leave(c *Client) {
+	r := h.rooms[c.room]
+	delete(r.clients, c)
+	if len(r.clients) == 0 && !r.fed {
+		delete(h.rooms, c.room)
+	}
+}
+
+// Join moves a registered client to another room. Its queue gets the new
+// room's snapshot, like a client that connected to the room (see Register),
+// in as much space as the queue has left. It returns false if c isn't
+// registered (anymore).
+func (h *Hub) Join(c *Client, name string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.registered(c) {
+		return false
+	}
+	if c.room == name {
+		return true
+	}
+	h.leave(c)
+	c.room = name
+	r := h.room(name)
+	r.clients[c] = true
+	// Only Run (under this lock) adds to the queue, so this much room can't shrink.
+	if space := cap(c.send) - len(c.send); space > 0 {
+		h.snapshot(c, r, space-1)
+	}
+	return true
+}
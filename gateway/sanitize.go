@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json" // For patching JSON packets
+	"log/slog"      // For reporting what was fixed
+	"math"          // For NaN and infinity checks
+	"sync"          // For sharing the counts between listeners
+	"time"          // For spacing the log lines
+)
+
+// --- Sanitizing ---
+// A buggy simulation can send coordinates a renderer chokes on: NaN, infinity
+// (protobuf carries both, JSON can't) or values so large the camera ends up
+// nowhere. With -sanitize such states are fixed before they are forwarded:
+//
+//	x, y      infinite or beyond ±bound: clamped to ±bound
+//	x, y      NaN: the packet is dropped, there is no sensible value to use
+//	heading   NaN or infinite: the packet is dropped
+//
+// It is opt-in, clamping hides the bug it protects against.
+
+// sanitizeLogInterval is how often fixed states are summed up in the log.
+const sanitizeLogInterval = 10 * time.Second
+
+// sanitizer fixes robot states, see above. It is safe for concurrent use, all listeners share one.
+type sanitizer struct {
+	bound float64
+
+	mutex   sync.Mutex
+	clamped int
+	dropped int
+	lastLog time.Time
+}
+
+// newSanitizer returns a sanitizer clamping coordinates to ±bound.
+func newSanitizer(bound float64) *sanitizer {
+	return &sanitizer{bound: bound}
+}
+
+// apply fixes `state` in place. It returns whether anything was changed and
+// false for `keep` if the packet must be dropped.
+func (s *sanitizer) apply(state *RobotState) (changed, keep bool) {
+	clamped := 0
+	keep = !math.IsNaN(state.X) && !math.IsNaN(state.Y) &&
+		!math.IsNaN(state.Heading) && !math.IsInf(state.Heading, 0)
+	if keep {
+		// SYNTAX: math.Max and math.Min bring infinity into range too.
+		for _, v := range []*float64{&state.X, &state.Y} {
+			if fixed := math.Max(-s.bound, math.Min(s.bound, *v)); fixed != *v {
+				*v = fixed
+				clamped++
+			}
+		}
+	}
+
+	if keep && clamped == 0 {
+		return false, true
+	}
+	if keep {
+		valuesClamped.Add(float64(clamped))
+	} else {
+		udpPacketsInsane.Inc()
+	}
+	s.report(state.ID, clamped, !keep)
+	return clamped > 0, keep
+}
+
+// report counts a fixed or dropped state and logs the totals every sanitizeLogInterval.
+func (s *sanitizer) report(id string, clamped int, dropped bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clamped += clamped
+	if dropped {
+		s.dropped++
+	}
+	if time.Since(s.lastLog) < sanitizeLogInterval {
+		return
+	}
+	slog.Warn("sanitized robot states with invalid values", "clamped", s.clamped, "dropped", s.dropped, "last_robot", id, "bound", s.bound)
+	s.clamped, s.dropped = 0, 0
+	s.lastLog = time.Now()
+}
+
+// patchCoordinates writes the (sanitized) coordinates of `state` back into a JSON
+// packet, keeping its other fields. It returns false if the packet isn't a JSON object.
+func patchCoordinates(packet []byte, state RobotState) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(packet, &fields); err != nil {
+		return packet, false
+	}
+	// Marshalling a finite float can't fail.
+	fields["x"], _ = json.Marshal(state.X)
+	fields["y"], _ = json.Marshal(state.Y)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return packet, false
+	}
+	return data, true
+}
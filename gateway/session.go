@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors" // For the Register errors
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Single Session per Identity ---
+// On an operator console two tabs of the same operator would fight over the
+// robots, each sending its own commands. With -single-session every identity
+// (the name of the token a client authenticated with, see parseAuthTokens) may
+// have one connection at a time. A second one is either turned away ("reject",
+// close code 1008 "session already active") or takes over ("replace"): the old
+// connection is closed with 1008 "session replaced", which a frontend should
+// show instead of reconnecting, or the two tabs would keep replacing each other.
+
+// The values of -single-session, see HubOptions.SingleSession.
+const (
+	sessionsOff     = "off"
+	sessionsReject  = "reject"
+	sessionsReplace = "replace"
+)
+
+// Register's errors.
+var (
+	errHubFull       = errors.New("too many clients")
+	errSessionActive = errors.New("session already active")
+)
+
+// claimSession makes c the session of its identity, according to
+// HubOptions.SingleSession. It returns the client c replaces, if any, which
+// the caller must end with displace once the mutex is released. The caller
+// must hold the mutex.
+func (h *Hub) claimSession(c *Client) (displaced *Client, err error) {
+	if c.identity == "" || h.opts.SingleSession == sessionsOff || h.opts.SingleSession == "" {
+		return nil, nil
+	}
+	if old := h.sessions[c.identity]; old != nil {
+		if h.opts.SingleSession == sessionsReject {
+			return nil, errSessionActive
+		}
+		// Out of the hub right away, so it frees its slot for c.
+		h.leave(old)
+		h.count--
+		displaced = old
+	}
+	h.sessions[c.identity] = c
+	return displaced, nil
+}
+
+// endSession forgets c as its identity's session, if it still is one.
+// The caller must hold the mutex.
+func (h *Hub) endSession(c *Client) {
+	if c.identity != "" && h.sessions[c.identity] == c {
+		delete(h.sessions, c.identity)
+	}
+}
+
+// displace closes a client that claimSession took out of the hub. Like
+// CloseAll it runs without the mutex: the write may take up to writeWait.
+func (c *Client) displace() {
+	c.setReason(reasonReplaced)
+	writeClose(c.conn, websocket.ClosePolicyViolation, "session replaced")
+	// The client is no longer in the hub, nothing else closes `send` anymore.
+	// That stops its writePump, which closes the connection.
+	close(c.send)
+}
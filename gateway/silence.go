@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"     // For stopping the watchdog
+	"fmt"         // For the error frame's detail
+	"log/slog"    // For the alert
+	"sync/atomic" // For the lock-free stream state
+	"time"        // For the timeout
+)
+
+// --- Silence Alert ---
+// When the robots on the dashboards stop moving, operators want to know
+// whether the simulation stopped sending or nobody is looking. With
+// -silence-timeout the gateway watches the whole stream: once no packet has
+// reached processPacket (from any address, or from a replay) for that long, it
+// logs a warning and the stream counts as unhealthy ("stream_healthy" in
+// "/stats", gateway_stream_healthy in "/metrics"). With -error-frames clients
+// get an error frame like {"type":"error","detail":"no data from the simulation
+// for 10s","count":0} too. The first packet afterwards makes it healthy again.
+//
+// "/readyz" doesn't change: a gateway whose simulation is down still serves
+// the last state, pulling it out of the load balancer wouldn't help anyone.
+// Packets dropped by -udp-allow or the rate limits don't count as data.
+
+// lastData is when the latest packet reached processPacket, in Unix
+// nanoseconds. Kept to activityResolution like udpActivity.last.
+var lastData atomic.Int64
+
+// streamSilent is set while the stream is silent, see streamHealthy.
+var streamSilent atomic.Bool
+
+// streamHealthy reports whether data has arrived within -silence-timeout.
+// Without -silence-timeout the stream always counts as healthy.
+func streamHealthy() bool {
+	return !streamSilent.Load()
+}
+
+// sawData records a packet that arrived at `now`.
+func sawData(now time.Time) {
+	if ns := now.UnixNano(); ns-lastData.Load() >= int64(activityResolution) {
+		lastData.Store(ns)
+	}
+	if streamSilent.Load() && streamSilent.CompareAndSwap(true, false) {
+		slog.Info("simulation data resumed")
+	}
+}
+
+// watchSilence checks every now and then whether the stream has been silent
+// for `timeout` until ctx is canceled. `errs` (nil without -error-frames)
+// tells the clients.
+func watchSilence(ctx context.Context, timeout time.Duration, errs *errorReporter) {
+	// Until the first packet the timeout counts from startup.
+	lastData.CompareAndSwap(0, time.Now().UnixNano())
+	ticker := time.NewTicker(max(timeout/4, activityResolution))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			quiet := now.Sub(time.Unix(0, lastData.Load()))
+			if quiet < timeout || !streamSilent.CompareAndSwap(false, true) {
+				continue
+			}
+			slog.Warn("simulation went silent", "for", quiet.Round(time.Second).String(), "silence_timeout", timeout.String())
+			if errs != nil {
+				errs.silence(quiet)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// silence sends clients an error frame saying that no data has arrived for `quiet`.
+func (r *errorReporter) silence(quiet time.Duration) {
+	detail := fmt.Sprintf("no data from the simulation for %s", quiet.Round(time.Second))
+	r.hub.SendAll(errorMessage(detail, 0, r.wrap))
+}
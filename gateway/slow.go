@@ -0,0 +1,72 @@
+package main
+
+import "time" // For how long a queue has been filling up
+
+// --- Slow Consumers ---
+// A client that can't keep up first fills its send queue, then loses messages
+// (see Client.queue). slowWatch notices the first part: a queue that keeps
+// reaching a fill level for a while gets a "slow consumer" warning in the log,
+// before the client starts dropping frames or gets disconnected by a failed write.
+//
+// The queue of a slow client rarely stays full: the kernel's send buffer takes
+// bursts of it whenever the client acknowledges some data, and writePump empties
+// the queue into it. So the watch looks at the highest level in every check
+// interval, not at single samples, which would often catch the queue just emptied.
+
+// slowWarnInterval is the least time between two warnings about the same client,
+// so a client that stays slow doesn't flood the log.
+const slowWarnInterval = time.Minute
+
+// slowWatch tracks one client's queue level. It is owned by writePump.
+type slowWatch struct {
+	// threshold is the queue level (in messages) that counts as "full".
+	threshold int
+	// after is how long the level must keep reaching threshold.
+	after time.Duration
+
+	// peak is the highest level observed since the last check.
+	peak int
+	// above is when the peak first reached the threshold, zero while it doesn't.
+	above time.Time
+	// warned is when the last warning was logged.
+	warned time.Time
+}
+
+// newSlowWatch returns a watch for a queue of the given capacity, warning once
+// it has kept getting at least `fill` (0..1) full for `after`. It returns nil for after <= 0.
+func newSlowWatch(capacity int, fill float64, after time.Duration) *slowWatch {
+	if after <= 0 {
+		return nil
+	}
+	return &slowWatch{threshold: max(1, int(fill*float64(capacity))), after: after}
+}
+
+// interval is how often check should be called.
+func (w *slowWatch) interval() time.Duration {
+	return min(time.Second, w.after)
+}
+
+// observe records the current queue level. It is cheap enough to call for every message.
+func (w *slowWatch) observe(level int) {
+	w.peak = max(w.peak, level)
+}
+
+// check ends a check interval. It reports whether a warning is due, the
+// interval's peak level, and for how long the peaks have been over the threshold.
+func (w *slowWatch) check(level int, now time.Time) (warn bool, peak int, lasted time.Duration) {
+	w.observe(level)
+	peak, w.peak = w.peak, 0
+	if peak < w.threshold {
+		w.above = time.Time{}
+		return false, peak, 0
+	}
+	if w.above.IsZero() {
+		w.above = now
+	}
+	lasted = now.Sub(w.above)
+	if lasted < w.after || now.Sub(w.warned) < slowWarnInterval {
+		return false, peak, lasted
+	}
+	w.warned = now
+	return true, peak, lasted
+}
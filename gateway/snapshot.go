@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip" // For compressing large snapshots
+	"net/http"      // For the handler
+	"strconv"       // For the q-values of Accept-Encoding
+	"strings"       // For parsing Accept-Encoding
+
+	"github.com/gorilla/websocket"
+)
+
+// minGzipSize is the smallest snapshot worth compressing. Below it the gzip
+// header and footer (18 bytes) eat most of the savings.
+const minGzipSize = 1024
+
+// handleSnapshot returns the handler for "/snapshot". It answers a plain GET
+// with the cached last message, for callers that want the current state once
+// and don't need a WebSocket stream. It answers 204 while there is none
+// (nothing received yet, or -cache-last is off). "/snapshot?room=swarm-a"
+// returns the last message of that room (see room.go).
+// A big swarm's snapshot is gzip compressed for callers that accept it, which
+// matters for dashboards polling it over a mobile connection. Methods other
+// than GET and HEAD get 405.
+func handleSnapshot(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// HEAD gets GET's headers, net/http leaves out the body itself.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		last := hub.Last(r.URL.Query().Get("room"))
+		if last == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Text messages are JSON robot states, binary ones are whatever the simulation sent.
+		if last.Type == websocket.TextMessage {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		// The snapshot changes with every packet, caches must always ask again.
+		w.Header().Set("Cache-Control", "no-store")
+		// The body depends on Accept-Encoding, even when it isn't compressed.
+		w.Header().Add("Vary", "Accept-Encoding")
+		if len(last.Data) < minGzipSize || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			w.Write(last.Data)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(last.Data)
+		// Close writes the footer, without it the response isn't valid gzip.
+		gz.Close()
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip,
+// e.g. "gzip, deflate, br" does and "gzip;q=0" or "identity" don't.
+// "*" counts as gzip unless gzip is listed on its own.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for part := range strings.SplitSeq(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		// A coding without a q-value is fully acceptable.
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"gzip, deflate, br":      true,
+		"deflate, gzip":          true,
+		"GZIP":                   true,
+		"x-gzip":                 true,
+		"identity":               false,
+		"deflate, br":            false,
+		"gzip;q=0":               false,
+		"gzip;q=0.000":           false,
+		"gzip; q=0.5":            true,
+		"gzip;q=bogus":           false,
+		"*":                      true,
+		"*;q=0":                  false,
+		"deflate, *;q=0.1":       true,
+		"gzip;q=0, *":            false, // gzip on its own wins over "*"
+		"*;q=0, gzip":            true,
+		" gzip ; q=1 , identity": true,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestSnapshotMethods(t *testing.T) {
+	hub := NewHub(HubOptions{QueueSize: 16, CacheLast: true})
+	hub.deliver(Message{Type: websocket.TextMessage, Data: frame(0)})
+	handler := handleSnapshot(hub)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/snapshot", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", method, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type = %q, want application/json", method, got)
+		}
+		if method == http.MethodGet && !bytes.Equal(w.Body.Bytes(), frame(0)) {
+			t.Errorf("GET: body = %s, want %s", w.Body, frame(0))
+		}
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/snapshot", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status = %d, want 405", method, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != "GET, HEAD" {
+			t.Errorf("%s: Allow = %q, want %q", method, got, "GET, HEAD")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json" // For decoding packets
+	"errors"        // For validation errors
+)
+
+// RobotState is the telemetry the simulation sends for one robot, e.g.
+// {"id": "robot_1", "x": 1.00, "y": 0.5, "heading": 1.57, "timestamp": 1768900000000}.
+// Missing numeric fields decode as 0, only the ID is required.
+type RobotState struct {
+	ID      string  `json:"id"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Heading float64 `json:"heading"` // radians
+	// Timestamp is when the simulation produced the state, in Unix milliseconds.
+	Timestamp int64 `json:"timestamp"`
+	// Seq is an optional per-packet sequence number, incremented by one for every
+	// packet the simulation sends (wrapping around at 2^32). It's a pointer so
+	// that "no sequence number" can be told apart from 0.
+	Seq *uint32 `json:"seq,omitempty"`
+	// Room is the room the state is broadcast to, "" for the one of the listener
+	// that received it (see room.go).
+	Room string `json:"room,omitempty"`
+}
+
+// errMissingID is returned for packets that are valid JSON but don't identify a robot.
+var errMissingID = errors.New("robot state has no id")
+
+// decodeRobotState parses and validates a UDP packet.
+func decodeRobotState(packet []byte) (RobotState, error) {
+	var state RobotState
+	if err := json.Unmarshal(packet, &state); err != nil {
+		return state, err
+	}
+	if state.ID == "" {
+		return state, errMissingID
+	}
+	return state, nil
+}
+
+// seqTracker detects lost packets from gaps in RobotState.Seq.
+type seqTracker struct {
+	last    uint32
+	started bool
+}
+
+// observe records a sequence number and returns how many packets went missing
+// between it and the previous one. Duplicates and late (reordered) packets
+// report 0. The subtraction is done in uint32, so 4294967295 -> 0 is not a gap.
+func (t *seqTracker) observe(seq uint32) uint32 {
+	if !t.started {
+		t.last, t.started = seq, true
+		return 0
+	}
+	// SYNTAX: unsigned arithmetic wraps around, so `seq - t.last` is the forward
+	// distance even across the 2^32 boundary.
+	delta := seq - t.last
+	// Going "forward" by more than half the number space really means the packet is older.
+	if delta == 0 || delta > 1<<31 {
+		return 0
+	}
+	t.last = seq
+	return delta - 1
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"           // For comparing counters when sorting
+	"encoding/json" // For the response body
+	"net/http"      // For the handler
+	"slices"        // For sorting the client list
+	"sync/atomic"   // For lock-free counters
+	"time"          // For uptime
+)
+
+// --- Lightweight Stats ---
+// "/stats" is a quick JSON summary for dashboards that don't run Prometheus.
+// The Prometheus counters can't be read back cheaply, so the totals shown
+// here are kept in plain atomics next to them.
+//
+// With -stats-clients it also lists every connected client with its own
+// counters, heaviest consumer first. That is one entry per client, so it is
+// off by default.
+
+// startTime is when the process started, for the uptime field.
+var startTime = time.Now()
+
+// Totals since startup. Updated by countPacket, countSent and countReceived, read by handleStats.
+// Unlike the per-client counters they include clients that have already disconnected.
+var (
+	totalPackets atomic.Uint64
+	totalBytes   atomic.Uint64
+
+	totalMessagesSent     atomic.Uint64
+	totalBytesSent        atomic.Uint64
+	totalMessagesReceived atomic.Uint64
+	totalBytesReceived    atomic.Uint64
+)
+
+// countPacket records one received packet of n bytes in both /stats and /metrics.
+func countPacket(n int) {
+	totalPackets.Add(1)
+	totalBytes.Add(uint64(n))
+	udpPacketsReceived.Inc()
+	udpBytesReceived.Add(float64(n))
+}
+
+// countSent records one data frame of n bytes written to a client.
+func countSent(n int) {
+	totalMessagesSent.Add(1)
+	totalBytesSent.Add(uint64(n))
+}
+
+// countReceived records one data frame of n bytes read from a client.
+func countReceived(n int) {
+	totalMessagesReceived.Add(1)
+	totalBytesReceived.Add(uint64(n))
+}
+
+// statsResponse is the JSON body of "/stats".
+type statsResponse struct {
+	Clients         int       `json:"clients"`
+	BroadcastHz     float64   `json:"broadcast_hz"`
+	PacketsReceived uint64    `json:"packets_received"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	UptimeSeconds   float64   `json:"uptime_seconds"`
+	IngestPaused    bool      `json:"ingest_paused"`
+	StreamHealthy   bool      `json:"stream_healthy"`
+	Build           buildInfo `json:"build"`
+
+	// DeliveryLatency are percentiles of the latest delivery latencies, see latency.go.
+	DeliveryLatency latencyPercentiles `json:"delivery_latency_ms"`
+
+	// WebSocket traffic of all clients, including disconnected ones.
+	WSMessagesSent     uint64 `json:"ws_messages_sent"`
+	WSBytesSent        uint64 `json:"ws_bytes_sent"`
+	WSMessagesReceived uint64 `json:"ws_messages_received"`
+	WSBytesReceived    uint64 `json:"ws_bytes_received"`
+
+	// PerClient is only filled in with -stats-clients.
+	// SYNTAX: `omitempty` leaves out an empty slice, so the field is absent without the flag (or clients).
+	PerClient []clientStats `json:"per_client,omitempty"`
+}
+
+// clientStats is one entry of statsResponse.PerClient.
+type clientStats struct {
+	ID               uint64  `json:"id"`
+	Remote           string  `json:"remote"`
+	ConnectedSeconds float64 `json:"connected_seconds"`
+	MessagesSent     uint64  `json:"messages_sent"`
+	BytesSent        uint64  `json:"bytes_sent"`
+	MessagesReceived uint64  `json:"messages_received"`
+	BytesReceived    uint64  `json:"bytes_received"`
+	Dropped          uint64  `json:"dropped"`
+}
+
+// handleStats returns the handler for "/stats". perClient adds the per-client list.
+func handleStats(hub *Hub, perClient bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := statsResponse{
+			Clients:            hub.Count(),
+			BroadcastHz:        hub.Rate(),
+			PacketsReceived:    totalPackets.Load(),
+			BytesReceived:      totalBytes.Load(),
+			UptimeSeconds:      time.Since(startTime).Seconds(),
+			IngestPaused:       hub.IngestPaused(),
+			StreamHealthy:      streamHealthy(),
+			Build:              currentBuild(),
+			DeliveryLatency:    deliveryLatencies.percentiles(),
+			WSMessagesSent:     totalMessagesSent.Load(),
+			WSBytesSent:        totalBytesSent.Load(),
+			WSMessagesReceived: totalMessagesReceived.Load(),
+			WSBytesReceived:    totalBytesReceived.Load(),
+		}
+		if perClient {
+			for _, c := range hub.Clients() {
+				resp.PerClient = append(resp.PerClient, clientStats{
+					ID:               c.id,
+					Remote:           c.conn.RemoteAddr().String(),
+					ConnectedSeconds: time.Since(c.connected).Seconds(),
+					MessagesSent:     c.messagesSent.Load(),
+					BytesSent:        c.bytesSent.Load(),
+					MessagesReceived: c.messagesReceived.Load(),
+					BytesReceived:    c.bytesReceived.Load(),
+					Dropped:          c.dropped.Load(),
+				})
+			}
+			// SYNTAX: slices.SortFunc sorts with a comparison function, b before a gives descending order.
+			slices.SortFunc(resp.PerClient, func(a, b clientStats) int {
+				return cmp.Compare(b.BytesSent, a.BytesSent)
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
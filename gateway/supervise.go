@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"       // For stopping restarts at shutdown
+	"fmt"           // For turning the panic value into text
+	"log/slog"      // For structured logging
+	"runtime/debug" // For the panicking goroutine's stack
+	"time"          // For the restart backoff
+
+	"github.com/gorilla/websocket"
+)
+
+// Backoff between restarts of a goroutine that keeps panicking. It doubles from
+// firstRestart up to maxRestart, and starts over once a run lasted stableRun.
+const (
+	firstRestart = 100 * time.Millisecond
+	maxRestart   = 10 * time.Second
+	stableRun    = time.Minute
+)
+
+// supervise runs fn until it returns. If fn panics, the panic is logged with
+// its stack, counted, and fn is started again after a backoff, so a bug
+// triggered by one bad packet doesn't take down every client's stream.
+// It gives up restarting once ctx is canceled. With recoverPanics off it just
+// calls fn, and a panic crashes the process as usual.
+//
+// fn must be safe to start again: state it keeps has to survive a panic,
+// e.g. by unlocking mutexes with defer (Hub does).
+func supervise(ctx context.Context, name string, recoverPanics bool, fn func(context.Context)) {
+	if !recoverPanics {
+		fn(ctx)
+		return
+	}
+	delay := firstRestart
+	for {
+		start := time.Now()
+		if !runRecovered(ctx, name, fn) {
+			return
+		}
+		if time.Since(start) >= stableRun {
+			delay = firstRestart
+		}
+		slog.Warn("restarting goroutine after panic", "goroutine", name, "delay", delay.String())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(2*delay, maxRestart)
+	}
+}
+
+// runRecovered calls fn and reports whether it panicked.
+func runRecovered(ctx context.Context, name string, fn func(context.Context)) (panicked bool) {
+	// SYNTAX: recover() only stops a panic when called directly by a deferred
+	// function. The named result lets the deferred function change what is returned.
+	defer func() {
+		if v := recover(); v != nil {
+			panicked = true
+			panicsRecovered.WithLabelValues(name).Inc()
+			slog.Error("goroutine panicked", "goroutine", name, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+		}
+	}()
+	fn(ctx)
+	return false
+}
+
+// recoverClient is deferred by the goroutines serving a client (readPump and
+// writePump). A panic there, e.g. in a client's filter, would otherwise end
+// the whole gateway: with recoverPanics set it is logged and counted like the
+// ones above, and only this client is dropped, closed with 1011 (internal
+// error) so the frontend can tell it from a network problem and reconnect.
+// Closing the connection ends the other pump as well.
+func (c *Client) recoverClient(name string, recoverPanics bool) {
+	if !recoverPanics {
+		return
+	}
+	// SYNTAX: recover works here because recoverClient itself is the deferred function.
+	v := recover()
+	if v == nil {
+		return
+	}
+	panicsRecovered.WithLabelValues(name).Inc()
+	c.log.Error("client goroutine panicked, dropping the client", "goroutine", name, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+	c.setReason(reasonInternalError)
+	writeClose(c.conn, websocket.CloseInternalServerErr, "internal error")
+	c.conn.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientPanicDropsOnlyThatClient(t *testing.T) {
+	conn := newFakeConn()
+	conn.panics = true
+	client := newClient(conn, 0)
+	client.send <- Message{Type: websocket.TextMessage, Data: []byte(`{"id":"robot_1"}`)}
+	before := counterValue(t, panicsRecovered.WithLabelValues("client writer"))
+
+	// Returns instead of crashing the test binary.
+	client.writePump(context.Background(), EndpointOptions{RecoverPanics: true})
+
+	if !conn.isClosed() {
+		t.Error("connection wasn't closed")
+	}
+	conn.mutex.Lock()
+	code := conn.closeCode
+	conn.mutex.Unlock()
+	if code != websocket.CloseInternalServerErr {
+		t.Errorf("close code = %d, want %d (internal error)", code, websocket.CloseInternalServerErr)
+	}
+	if reason := client.disconnectReason(); reason != reasonInternalError {
+		t.Errorf("disconnect reason = %q, want %q", reason, reasonInternalError)
+	}
+	if got := counterValue(t, panicsRecovered.WithLabelValues("client writer")) - before; got != 1 {
+		t.Errorf("recovered panics went up by %v, want 1", got)
+	}
+}
+
+// A panic in one of fanOut's workers has to reach supervise like one in Run
+// itself, on its own goroutine nothing would recover it.
+func TestBroadcastWorkerPanicIsRecovered(t *testing.T) {
+	hub := NewHub(HubOptions{QueueSize: 16})
+	clients := make([]*Client, 4)
+	for i := range clients {
+		clients[i] = register(t, hub, newFakeConn())
+	}
+	// A bug: sending to a closed queue panics.
+	close(clients[0].send)
+	before := counterValue(t, panicsRecovered.WithLabelValues("broadcaster"))
+
+	hub.mutex.Lock()
+	panicked := runRecovered(context.Background(), "broadcaster", func(context.Context) {
+		hub.fanOut(Message{Type: websocket.TextMessage, Data: frame(0)}, nil, hub.rooms[defaultRoom], 2)
+	})
+	hub.mutex.Unlock()
+
+	if !panicked {
+		t.Fatal("the worker's panic didn't reach runRecovered")
+	}
+	if got := counterValue(t, panicsRecovered.WithLabelValues("broadcaster")) - before; got != 1 {
+		t.Errorf("recovered panics went up by %v, want 1", got)
+	}
+}
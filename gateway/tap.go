@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"        // For copying tapped packets
+	"unicode/utf8" // For picking the frame type
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Raw UDP Tap ---
+// When clients see something odd, the first question is whether the simulation
+// sent it that way or the gateway changed it. "/ws/raw" on the admin server
+// answers it: it streams every UDP packet exactly as it arrived, before
+// decoding, sanitizing, transcoding, tagging, the pipeline (see pipeline.go)
+// or decimation, whatever the flags say. Like a recording (see record.go) it
+// only sees packets the allowlist and the rate limits let through.
+//
+// The tap is a hub of its own with every feature turned off, so its clients are
+// ordinary clients (queues, pings, slow consumer warnings) that never slow
+// down the real stream. They don't count towards -max-clients, and an
+// operator watching isn't audience: they stay out of gateway_clients_connected,
+// the connect and disconnect counters and "/stats". Pick a listener's room
+// with /ws/raw?room=swarm-a.
+
+// maxTapClients caps the clients of the tap, it is a debugging tool.
+const maxTapClients = 8
+
+// newTapHub returns the hub behind "/ws/raw".
+func newTapHub(queueSize int) *Hub {
+	return NewHub(HubOptions{
+		MaxClients: maxTapClients,
+		QueueSize:  queueSize,
+		Untracked:  true,
+	})
+}
+
+// tapPacket hands a received packet to the tap's clients, if there are any.
+// `room` is the listener's room, the packet isn't decoded to find its own.
+func tapPacket(tap *Hub, packet []byte, room string) {
+	if tap == nil || tap.Count() == 0 {
+		return
+	}
+	msg := Message{Type: websocket.TextMessage, Data: bytes.Clone(packet), Room: room}
+	// Browsers reject text frames that aren't UTF-8, like the real stream without -binary.
+	if !utf8.Valid(msg.Data) {
+		msg.Type = websocket.BinaryMessage
+	}
+	tap.Broadcast(msg)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// "/ws/raw" shows every packet as it arrives, so it is guarded like
+// "/notify", and it is for watching only: commands sent to it go nowhere.
+func TestRawTapIsGuardedAndReadOnly(t *testing.T) {
+	tokens, err := parseAuthTokens("alice:s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like main with the -allowed-origins default, so only requireOperator can refuse a page.
+	origins := parseOrigins("*")
+	old := upgrader.CheckOrigin
+	upgrader.CheckOrigin = origins.allow
+	t.Cleanup(func() { upgrader.CheckOrigin = old })
+	hub := startHub(t, HubOptions{})
+	tap := startHub(t, HubOptions{Untracked: true})
+	admin := newAdminServer("", hub, tap, EndpointOptions{Coalesce: 1}, false, origins, tokens)
+	srv := httptest.NewServer(admin.Handler)
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/raw"
+
+	// Both are turned away with a close frame the page can read, see reject.
+	for name, dial := range map[string]struct {
+		query  string
+		header http.Header
+	}{
+		"without token":           {},
+		"foreign page with token": {query: "?token=s3cret", header: http.Header{"Origin": {"https://evil.example"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial(url+dial.query, dial.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("got %v, want close code %d", err, websocket.ClosePolicyViolation)
+			}
+			if n := tap.Count(); n != 0 {
+				t.Errorf("tap has %d clients, want none", n)
+			}
+		})
+	}
+
+	t.Run("with token", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(url+"?token=s3cret", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		waitFor(t, "the tap client to register", func() bool { return tap.Count() == 1 })
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd":"stop","robot":"robot_1","ack":1}`)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), errReadOnly.Error()) {
+			t.Errorf("reply to an acknowledged command = %s, want it to fail with %q", data, errReadOnly)
+		}
+	})
+}
+
+// An operator watching the tap isn't one of the gateway's clients, neither in
+// "/stats" nor in the client metrics.
+func TestRawTapIsNotAnAudience(t *testing.T) {
+	hub := startHub(t, HubOptions{})
+	tap := startHub(t, HubOptions{Untracked: true})
+	admin := newAdminServer("", hub, tap, EndpointOptions{Coalesce: 1}, false, parseOrigins("*"), nil)
+	srv := httptest.NewServer(admin.Handler)
+	t.Cleanup(srv.Close)
+	stats := func() statsResponse {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s statsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	before, connects := stats(), counterValue(t, clientConnects)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/raw", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, "the tap client to register", func() bool { return tap.Count() == 1 })
+	// Traffic both ways. The replies are written one after the other, so once
+	// the second arrived the first one has been counted, if it is counted at all.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range 2 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd":"stop","robot":"robot_1","ack":1}`)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	during := stats()
+	if during.Clients != before.Clients {
+		t.Errorf("/stats counts %d clients with the tap connected, want %d", during.Clients, before.Clients)
+	}
+	if during.WSMessagesSent != before.WSMessagesSent || during.WSMessagesReceived != before.WSMessagesReceived {
+		t.Errorf("/stats counts %d sent and %d received messages, want the tap's left out (%d and %d)",
+			during.WSMessagesSent, during.WSMessagesReceived, before.WSMessagesSent, before.WSMessagesReceived)
+	}
+	if got := counterValue(t, clientConnects); got != connects {
+		t.Errorf("gateway_client_connects_total = %v with the tap connected, want %v", got, connects)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"         // For stopping the accept loop's clients
+	"encoding/binary" // For the length prefix
+	"errors"          // For recognizing a closed listener
+	"io"              // For recognizing the end of the stream
+	"log/slog"        // For structured logging
+	"net"             // For the TCP listener
+	"slices"          // For growing the read buffer
+	"sync/atomic"     // For the ping flag
+	"time"            // For deadlines and the accept backoff
+	"unicode/utf8"    // For telling text frames from binary ones
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Length-Prefixed TCP Clients ---
+// Tools outside a browser often find a plain TCP stream easier to consume than
+// WebSocket. With -tcp-addr the gateway accepts them there: every frame a "/ws"
+// client would get is written as a 4-byte big-endian length followed by that
+// many bytes of payload. Frames a TCP client sends are framed the same way and
+// handled like WebSocket messages (control messages, commands), so e.g.
+// {"subscribe":["robot_1"]} or {"format":"binary"} work as usual.
+//
+// The differences to WebSocket:
+//   - There are no frame types: a client knows from the format it asked for
+//     (see format.go) whether to expect JSON or protobuf.
+//   - A zero-length frame is a keepalive, sent every pingPeriod. Clients skip
+//     it and may send empty frames themselves, which are ignored. Dead peers
+//     are found by TCP keepalive and the write deadline instead of pongs.
+//   - There are no close frames, the connection is simply closed (e.g. on
+//     shutdown, or when another session of the same identity takes over).
+//   - With -auth-token the client's first frame must be its token. A client
+//     that doesn't send a valid one within tcpAuthWait is disconnected.
+//   - The length prefix says up front how much memory a frame will take, so a
+//     frame over the limit ends the connection before it is read. The limit is
+//     -max-message-size, but never more than tcpMaxFrame (even with 0), and
+//     tcpMaxTokenFrame for the token: nobody has to authenticate to send it.
+//
+// TCP clients share the hub with the WebSocket ones, so they count towards
+// -max-clients and get the snapshot, history and every -envelope frame.
+// With -tls-cert the listener speaks TLS.
+
+// tcpHeaderSize is the size of the length prefix.
+const tcpHeaderSize = 4
+
+// tcpAuthWait is how long a TCP client has to present its token.
+const tcpAuthWait = 10 * time.Second
+
+// tcpReadChunk is how much tcpConn reads from the socket at a time.
+const tcpReadChunk = 4096
+
+// tcpMaxFrame is the largest frame a TCP client may ever send. Without it a
+// prefix of 0xFFFFFFFF would have the gateway buffer up to 4 GiB for one frame.
+const tcpMaxFrame = 16 << 20
+
+// tcpMaxTokenFrame is the largest frame accepted before the client is
+// authenticated, plenty for a token.
+const tcpMaxTokenFrame = 1024
+
+// tcpConn adapts a TCP connection to the Conn interface, so the client's
+// readPump and writePump run on it unchanged.
+type tcpConn struct {
+	// SYNTAX: embedding net.Conn gives tcpConn its SetReadDeadline, SetWriteDeadline, RemoteAddr and Close.
+	net.Conn
+
+	// limit is the largest frame the client may send, see newTCPConn.
+	limit int64
+
+	// in holds what was read from the socket but isn't a whole frame yet.
+	// A read deadline can strike in the middle of a frame, the next
+	// ReadMessage then carries on where it stopped.
+	in []byte
+
+	// header is the length prefix, reused by every write. Only writePump writes.
+	header [tcpHeaderSize]byte
+
+	// pong is readPump's pong handler. pinged is set when a keepalive was
+	// written, ReadMessage then treats the next read timeout like an arriving
+	// pong, see ReadMessage.
+	pong   func(appData string) error
+	pinged atomic.Bool
+}
+
+// SYNTAX: the compiler checks that *tcpConn implements Conn.
+var _ Conn = (*tcpConn)(nil)
+
+// newTCPConn wraps conn. Frames over `limit` bytes end the connection, 0 or
+// anything over tcpMaxFrame means tcpMaxFrame.
+func newTCPConn(conn net.Conn, limit int64) *tcpConn {
+	if limit <= 0 || limit > tcpMaxFrame {
+		limit = tcpMaxFrame
+	}
+	return &tcpConn{Conn: conn, limit: limit}
+}
+
+// ReadMessage returns the next non-empty frame, as a text message if it is
+// valid UTF-8 and as a binary one otherwise (like the tap, see tap.go).
+// A TCP client can't answer pings, so readPump's pong deadline would end
+// every connection of a client that only listens. Once a keepalive got out
+// since the last time, a read timeout is handed to the pong handler instead,
+// which moves the deadline on. On this goroutine, like gorilla calls it.
+func (c *tcpConn) ReadMessage() (int, []byte, error) {
+	for {
+		frame, err := c.readFrame()
+		// SYNTAX: errors.As finds an error of the given type in the chain and stores it.
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && c.pong != nil && c.pinged.Swap(false) {
+			if err := c.pong(""); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		if !utf8.Valid(frame) {
+			return websocket.BinaryMessage, frame, nil
+		}
+		return websocket.TextMessage, frame, nil
+	}
+}
+
+// readFrame reads until `in` holds a whole frame and returns its payload.
+// The end of the stream between two frames is a normal closure, in the middle
+// of one it is reported like a WebSocket connection that broke off (1006).
+func (c *tcpConn) readFrame() ([]byte, error) {
+	for {
+		if len(c.in) >= tcpHeaderSize {
+			size := int64(binary.BigEndian.Uint32(c.in))
+			if size > c.limit {
+				return nil, websocket.ErrReadLimit
+			}
+			if end := tcpHeaderSize + int(size); len(c.in) >= end {
+				frame := slices.Clone(c.in[tcpHeaderSize:end])
+				// Keep the rest (the start of the next frame) at the front of the buffer.
+				c.in = append(c.in[:0], c.in[end:]...)
+				return frame, nil
+			}
+		}
+		c.in = slices.Grow(c.in, tcpReadChunk)
+		n, err := c.Conn.Read(c.in[len(c.in):cap(c.in)])
+		c.in = c.in[:len(c.in)+n]
+		switch {
+		case errors.Is(err, io.EOF) && len(c.in) == 0:
+			return nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+		case errors.Is(err, io.EOF):
+			return nil, &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+		case err != nil:
+			return nil, err
+		}
+	}
+}
+
+// WriteMessage writes one frame. The type isn't sent, see the comment at the top.
+func (c *tcpConn) WriteMessage(messageType int, data []byte) error {
+	binary.BigEndian.PutUint32(c.header[:], uint32(len(data)))
+	// SYNTAX: net.Buffers writes several slices at once (writev), so the prefix doesn't cost a syscall of its own.
+	buffers := net.Buffers{c.header[:], data}
+	_, err := buffers.WriteTo(c.Conn)
+	return err
+}
+
+// WriteControl writes a ping as a zero-length keepalive frame. Close frames
+// don't exist here, the connection is closed right after them anyway.
+func (c *tcpConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != websocket.PingMessage {
+		return nil
+	}
+	c.SetWriteDeadline(deadline)
+	if err := c.WriteMessage(messageType, nil); err != nil {
+		return err
+	}
+	c.pinged.Store(true)
+	return nil
+}
+
+// SetPongHandler stores readPump's pong handler, see ReadMessage.
+func (c *tcpConn) SetPongHandler(h func(appData string) error) {
+	c.pong = h
+}
+
+// serveTCP accepts TCP clients on ln until it is closed. `tokens` are
+// -auth-token's, `opts` apply to every client like for a WebSocket endpoint.
+func serveTCP(ctx context.Context, ln net.Listener, hub *Hub, tokens []authToken, opts EndpointOptions) {
+	slog.Info("TCP listener up", "tcp_addr", ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// E.g. out of file descriptors, which may pass once clients go away.
+			slog.Warn("accepting TCP client failed", "err", err)
+			time.Sleep(firstBindRetry)
+			continue
+		}
+		go handleTCPClient(ctx, conn, hub, tokens, opts)
+	}
+}
+
+// handleTCPClient authenticates a TCP client (with tokens) and serves it like
+// handleConnections serves a WebSocket client.
+func handleTCPClient(ctx context.Context, conn net.Conn, hub *Hub, tokens []authToken, opts EndpointOptions) {
+	remote := conn.RemoteAddr().String()
+	if hub.Full() {
+		slog.Warn("TCP client rejected, limit reached", "remote", remote)
+		conn.Close()
+		return
+	}
+	tc := newTCPConn(conn, opts.MaxMessageSize)
+
+	identity := ""
+	if len(tokens) > 0 {
+		tc.SetReadDeadline(time.Now().Add(tcpAuthWait))
+		limit := tc.limit
+		tc.limit = min(limit, tcpMaxTokenFrame)
+		_, token, err := tc.ReadMessage()
+		tc.limit = limit
+		if err == nil {
+			identity = matchToken(tokens, string(token))
+		}
+		if identity == "" {
+			slog.Warn("TCP client rejected, bad token", "remote", remote)
+			conn.Close()
+			return
+		}
+	}
+
+	client := newClient(tc, opts.MaxHz)
+	client.identity = identity
+	serveClient(ctx, hub, client, opts)
+}
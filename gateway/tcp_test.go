@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeFrame writes a length prefix announcing `size` bytes, followed by `payload`.
+func writeFrame(t *testing.T, conn net.Conn, size int, payload []byte) {
+	t.Helper()
+	var header [tcpHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(size))
+	go conn.Write(append(header[:], payload...))
+}
+
+// The prefix is checked before the frame is read, so a client can't make the
+// gateway buffer more than the limit, not even with -max-message-size 0.
+func TestTCPFrameLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		size    int
+		wantErr bool
+	}{
+		{name: "at the limit", limit: 100, size: 100},
+		{name: "over the limit", limit: 100, size: 101, wantErr: true},
+		{name: "no limit, huge prefix", limit: 0, size: 1<<32 - 1, wantErr: true},
+		{name: "no limit, over the hard maximum", limit: 0, size: tcpMaxFrame + 1, wantErr: true},
+		{name: "limit above the hard maximum", limit: 1 << 30, size: tcpMaxFrame + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			var payload []byte
+			if !tt.wantErr {
+				payload = []byte(strings.Repeat("x", tt.size))
+			}
+			writeFrame(t, client, tt.size, payload)
+
+			conn := newTCPConn(server, tt.limit)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, got, err := conn.ReadMessage()
+			if tt.wantErr {
+				if !errors.Is(err, websocket.ErrReadLimit) {
+					t.Fatalf("got %v, want %v", err, websocket.ErrReadLimit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.size {
+				t.Errorf("got a frame of %d bytes, want %d", len(got), tt.size)
+			}
+		})
+	}
+}
+
+// Before the token nobody knows who is sending, a big first frame ends the
+// connection even though -max-message-size would allow it.
+func TestTCPTokenFrameLimit(t *testing.T) {
+	tokens, err := parseAuthTokens("alice:s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := startHub(t, HubOptions{})
+	opts := EndpointOptions{MaxMessageSize: 1 << 20}
+	connect := func(t *testing.T) (net.Conn, <-chan struct{}) {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleTCPClient(t.Context(), server, hub, tokens, opts)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			client.Close()
+			<-done
+		})
+		return client, done
+	}
+
+	t.Run("oversized token", func(t *testing.T) {
+		client, done := connect(t)
+		writeFrame(t, client, tcpMaxTokenFrame+1, nil)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client with an oversized token frame is still connected")
+		}
+		if n := hub.Count(); n != 0 {
+			t.Errorf("hub counts %d clients, want none", n)
+		}
+	})
+
+	t.Run("valid token", func(t *testing.T) {
+		client, _ := connect(t)
+		writeFrame(t, client, len("s3cret"), []byte("s3cret"))
+		// The client is served now, keep reading so its writes don't block the pipe.
+		go func() {
+			buf := make([]byte, tcpReadChunk)
+			for {
+				if _, err := client.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		waitFor(t, "the client to register", func() bool { return hub.Count() == 1 })
+	})
+}
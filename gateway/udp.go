@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"        // For copying packets out of the read buffer
+	"context"      // For stopping the listeners
+	"errors"       // For inspecting wrapped errors (e.g. net.ErrClosed)
+	"fmt"          // For describing bad addresses
+	"log/slog"     // For structured logging
+	"net"          // For networking operations (UDP, Unix datagram sockets)
+	"os"           // For removing socket files
+	"strings"      // For recognizing unixgram: addresses
+	"sync"         // For guarding the set of listeners
+	"sync/atomic"  // For the time of the last packet
+	"time"         // For the bind retry backoff
+	"unicode/utf8" // For telling text payloads from binary ones
+
+	"github.com/gorilla/websocket"
+)
+
+// maxUDPPayload is the largest payload a single UDP datagram over IPv4 can carry
+// (65535 minus the 8-byte UDP header and the 20-byte IP header).
+const maxUDPPayload = 65507
+
+// maxUDPBuffer is the largest read buffer that can make a difference, the UDP
+// length field can't describe a bigger datagram. Over IPv6 a payload may be up
+// to 65527 bytes, so it is more than maxUDPPayload.
+const maxUDPBuffer = 65535
+
+// Backoff between attempts to bind a UDP address that is in use. It doubles from
+// firstBindRetry up to maxBindRetry.
+const (
+	firstBindRetry = 100 * time.Millisecond
+	maxBindRetry   = 5 * time.Second
+)
+
+// errListenersClosed is returned by udpListeners.listen after Close or once its context is canceled.
+var errListenersClosed = errors.New("UDP listeners closed")
+
+// unixgramPrefix marks an ingest address as a Unix datagram socket, e.g.
+// "unixgram:/run/gateway/ingest.sock". When the simulation runs on the same
+// host (or in the same container) that saves the UDP/IP stack and can't collide
+// with other ports. The packets are the same as over UDP.
+const unixgramPrefix = "unixgram:"
+
+// ingestAddr is one -udp-addr entry: a UDP address or, with unixgramPrefix, a socket file.
+type ingestAddr struct {
+	// Exactly one of them is set.
+	udp  *net.UDPAddr
+	unix *net.UnixAddr
+
+	// room is where packets that don't name a room go, see room.go.
+	room string
+}
+
+// parseIngestAddr parses s, UDP addresses are resolved for `network` (see validUDPNetwork).
+// An entry may start with a room name, "swarm-a=:8000" receives swarm-a's packets on :8000.
+func parseIngestAddr(network, s string) (ingestAddr, error) {
+	var room string
+	// Addresses themselves never contain "=" before their ":" or "/".
+	if name, rest, ok := strings.Cut(s, "="); ok && !strings.ContainsAny(name, ":/[") {
+		if !validRoomName(name) {
+			return ingestAddr{}, fmt.Errorf("%q: invalid room name", s)
+		}
+		room, s = name, rest
+	}
+	if path, ok := strings.CutPrefix(s, unixgramPrefix); ok {
+		if path == "" {
+			return ingestAddr{}, fmt.Errorf("%q: missing socket path", s)
+		}
+		return ingestAddr{unix: &net.UnixAddr{Name: path, Net: "unixgram"}, room: room}, nil
+	}
+	addr, err := net.ResolveUDPAddr(network, s)
+	if err != nil {
+		return ingestAddr{}, err
+	}
+	return ingestAddr{udp: addr, room: room}, nil
+}
+
+// listenerRooms returns the rooms named by the -udp-addr entries.
+func listenerRooms(addrs []ingestAddr) []string {
+	var rooms []string
+	for _, addr := range addrs {
+		if addr.room != defaultRoom {
+			rooms = append(rooms, addr.room)
+		}
+	}
+	return rooms
+}
+
+// String returns the address without the room, as it is bound.
+func (a ingestAddr) String() string {
+	if a.unix != nil {
+		return unixgramPrefix + a.unix.Name
+	}
+	return a.udp.String()
+}
+
+// packetConn is what startUDPServer reads from, a *net.UDPConn or a *net.UnixConn.
+type packetConn interface {
+	net.PacketConn
+	SetReadBuffer(bytes int) error
+}
+
+// udpListeners is the set of bound ingest sockets (UDP and Unix datagram).
+// Sockets are bound in the background (see listen) while `main` needs to close
+// all of them during shutdown, so they are collected here instead of in a plain slice.
+type udpListeners struct {
+	// network is "udp", "udp4" or "udp6", see validUDPNetwork.
+	network string
+
+	// readers is the number of sockets bound for every UDP address, see
+	// -udp-readers. Above 1 they are bound with SO_REUSEPORT (see reuseport_linux.go).
+	readers int
+
+	mutex  sync.Mutex
+	conns  []packetConn
+	closed bool
+	// paths are the socket files to remove on Close.
+	paths []string
+}
+
+func newUDPListeners(network string, readers int) *udpListeners {
+	return &udpListeners{network: network, readers: readers}
+}
+
+// validUDPNetwork reports whether network can be used with net.ListenUDP.
+// "udp" binds wildcard addresses dual-stack (IPv4 and IPv6) where the OS supports
+// it, "udp4" and "udp6" only accept their own address family.
+func validUDPNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// listen binds addr. If that fails (typically because the previous gateway
+// still holds the port during a redeploy), it keeps retrying with backoff for
+// up to `retryFor` and returns the last error after that. Once ctx is canceled
+// it stops retrying and returns errListenersClosed.
+func (l *udpListeners) listen(ctx context.Context, addr ingestAddr, retryFor time.Duration) (packetConn, error) {
+	giveUp := time.Now().Add(retryFor)
+	delay := firstBindRetry
+	for attempt := 1; ; attempt++ {
+		conn, err := l.bind(addr)
+		if err == nil {
+			return conn, l.add(conn, addr)
+		}
+		if time.Now().Add(delay).After(giveUp) {
+			return nil, err
+		}
+		slog.Warn("UDP listen failed, retrying", "addr", addr.String(), "attempt", attempt, "retry_in", delay.String(), "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, errListenersClosed
+		}
+		delay = min(delay*2, maxBindRetry)
+	}
+}
+
+// bind opens one socket for addr.
+func (l *udpListeners) bind(addr ingestAddr) (packetConn, error) {
+	if addr.unix == nil {
+		if l.readers > 1 {
+			return listenReusePort(l.network, addr.udp)
+		}
+		return net.ListenUDP(l.network, addr.udp)
+	}
+	// A socket file left behind by a gateway that crashed would make binding fail
+	// forever. Only sockets are removed, a typo must not delete someone's file.
+	if info, err := os.Lstat(addr.unix.Name); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr.unix.Name)
+	}
+	return net.ListenUnixgram("unixgram", addr.unix)
+}
+
+// add keeps conn so Close closes it (and removes its socket file). If Close was
+// already called, that happens right away and errListenersClosed is returned.
+func (l *udpListeners) add(conn packetConn, addr ingestAddr) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		conn.Close()
+		if addr.unix != nil {
+			os.Remove(addr.unix.Name)
+		}
+		return errListenersClosed
+	}
+	l.conns = append(l.conns, conn)
+	if addr.unix != nil {
+		l.paths = append(l.paths, addr.unix.Name)
+	}
+	return nil
+}
+
+// Close closes all bound sockets, later ones are closed as soon as they are bound.
+// Closing a socket makes the blocked ReadFrom in its startUDPServer return,
+// which ends the loop. Unlike stream listeners, closing a Unix datagram socket
+// leaves its file behind, so Close removes those.
+func (l *udpListeners) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	for _, path := range l.paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("removing socket file failed", "path", path, "err", err)
+		}
+	}
+}
+
+// UDPOptions configures startUDPServer.
+type UDPOptions struct {
+	// Codec decodes the packets, see codec.go.
+	Codec Codec
+
+	// TranscodeJSON re-encodes decoded states as JSON before forwarding them,
+	// for codecs browsers can't read. Otherwise packets are forwarded as received.
+	TranscodeJSON bool
+
+	// Strict drops packets that aren't a valid RobotState instead of forwarding them unchanged.
+	Strict bool
+
+	// Sanitize, if set, clamps or drops states with coordinates a renderer can't draw, see sanitize.go.
+	Sanitize *sanitizer
+
+	// Errors, if set, tells clients about the packets Strict drops (see errorReporter).
+	Errors *errorReporter
+
+	// Binary sends every payload as a binary WebSocket frame. Otherwise only
+	// payloads that aren't valid UTF-8 are sent as binary.
+	Binary bool
+
+	// BufferSize is the size of the read buffer, datagrams larger than this are truncated.
+	// It is also requested as the socket's kernel receive buffer.
+	BufferSize int
+
+	// Recorder, if set, gets a copy of every received packet (see record.go).
+	Recorder *Recorder
+
+	// MaxPPS and MaxBPS limit the packets and bytes per second every listener
+	// accepts, excess packets are dropped right after reading them (see ingressLimiter).
+	// 0 means unlimited.
+	MaxPPS float64
+	MaxBPS float64
+
+	// TagSource adds a "shard" field with the receiving port and a "source" field
+	// with the sender's IP:port to JSON object packets, so clients can tell sources
+	// apart when several UDP addresses are configured or several robot hosts send.
+	TagSource bool
+
+	// Allow, if set, only accepts packets from these senders, see allow.go.
+	Allow *senderAllowlist
+
+	// Room is the room of packets that don't name one, see room.go.
+	// Every listener has its own (see ingestAddr).
+	Room string
+
+	// Tap, if set, gets every packet as it was received, see tap.go.
+	Tap *Hub
+
+	// Sample only broadcasts every Sample-th packet of a listener, starting
+	// with the first. The others still refresh the last-message cache, so new
+	// clients start from the latest state. 0 or 1 broadcasts every packet.
+	Sample int
+
+	// ReadTimeout bounds every read, so a reader that gets no packets still
+	// wakes up to check ctx and whether its address went silent (see
+	// udpActivity). 0 blocks until a packet arrives or the socket is closed.
+	ReadTimeout time.Duration
+}
+
+// startUDPServer reads incoming packets from the simulation service, over UDP
+// or a Unix datagram socket (see unixgramPrefix).
+// Every packet is checked to be a valid RobotState, in strict mode invalid
+// packets are dropped, otherwise they're forwarded unchanged like before.
+// Valid packets are forwarded as received, unless TranscodeJSON re-encodes them.
+// Payloads go out as text frames unless they aren't valid UTF-8 (e.g. packed floats)
+// or Binary is set, browsers would otherwise reject or mangle them.
+// It returns once `conn` is closed (see shutdown) or ctx is canceled.
+// `limiter` sheds floods and `activity` notices silence, the readers of one
+// address share them (see -udp-readers).
+func startUDPServer(ctx context.Context, conn packetConn, hub *Hub, opts UDPOptions, limiter *ingressLimiter, activity *udpActivity) {
+	// The read loop below is blocked in ReadFrom most of the time and can't
+	// watch ctx itself, closing the socket makes the read fail instead.
+	// SYNTAX: context.AfterFunc runs the function in its own goroutine once ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// A larger kernel buffer absorbs bursts while we are busy. The kernel may cap
+	// the value (net.core.rmem_max on Linux), that is not an error.
+	if err := conn.SetReadBuffer(opts.BufferSize); err != nil {
+		slog.Warn("setting UDP receive buffer failed", "size", opts.BufferSize, "err", err)
+	}
+
+	// Create a buffer to hold the incoming data. A datagram that doesn't fit is cut off.
+	buf := make([]byte, opts.BufferSize)
+
+	// Tracks the packets' sequence numbers to make UDP packet loss visible.
+	// Every listener has its own tracker, shards number their packets independently.
+	// With several readers the kernel keeps each sender on one socket, so a
+	// sender's numbers still arrive at a single tracker.
+	var seq seqTracker
+
+	// The receiving port identifies the shard when tagging is on.
+	// A Unix socket has no port, its packets are shard 0.
+	var shard int
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		shard = addr.Port
+	}
+
+	// Counts the packets that made it past the limiter, for Sample. Each
+	// reader counts its own.
+	var packets int
+
+	// From here on we are reading, "/readyz" may report ready. When the loop ends
+	// (socket closed) this source is gone.
+	sourcesRunning.Add(1)
+	defer sourcesRunning.Add(-1)
+
+	// `for {}` is an infinite loop, so the server listens until the socket is closed.
+	for {
+		// A deadline is absolute, so it has to be moved on before every read.
+		if opts.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(opts.ReadTimeout))
+		}
+		// Read data from the socket into the buffer.
+		// `n` is the number of bytes read, `from` is the sender's address.
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			// A closed socket will never deliver data again, so stop instead of spinning.
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// A timeout only means no packet arrived within ReadTimeout, that is
+			// the reader's chance to look around, not a failure.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if ctx.Err() != nil {
+					return
+				}
+				activity.idle(time.Now(), opts.ReadTimeout)
+				continue
+			}
+			// Any other error is transient, skip to the next iteration.
+			slog.Warn("UDP read failed", "err", err)
+			continue
+		}
+
+		// The kernel silently discards whatever didn't fit, a completely full
+		// buffer is the only hint we get.
+		if n == len(buf) {
+			slog.Warn("UDP packet filled the whole read buffer, it may have been truncated", "size", n)
+		}
+
+		countPacket(n)
+		if opts.ReadTimeout > 0 {
+			activity.saw(time.Now())
+		}
+
+		// Unknown senders are dropped before they cost anything, even rate limit tokens.
+		// A flood is shed here, before it costs decoding, the hub's time and every client's bandwidth.
+		if !opts.Allow.allow(from) || !limiter.allow(n) {
+			continue
+		}
+
+		// The recording is a raw capture, so it gets every packet, even ones dropped below.
+		// Failing to record must not interrupt the live stream.
+		if opts.Recorder != nil {
+			if err := opts.Recorder.Write(buf[:n]); err != nil && !errors.Is(err, errRecorderClosed) {
+				slog.Warn("recording packet failed", "err", err)
+			}
+		}
+
+		tapPacket(opts.Tap, buf[:n], opts.Room)
+
+		// The hub keeps messages around (queues, last-state cache) while we already
+		// read the next packet into `buf`, so it must get its own copy.
+		packet := bytes.Clone(buf[:n])
+		source := &packetSource{shard: shard, addr: from, room: opts.Room}
+		// Sampled out packets are processed all the same, the hub only caches them.
+		// That way `seq` still sees every packet and doesn't report them as lost.
+		source.cacheOnly = opts.Sample > 1 && packets%opts.Sample != 0
+		packets++
+		processPacket(packet, source, hub, opts, &seq)
+	}
+}
+
+// ingressLimiter sheds UDP packets beyond UDPOptions.MaxPPS and MaxBPS.
+// Every address has its own, shared by its readers (see -udp-readers).
+type ingressLimiter struct {
+	// mutex guards everything below, the readers call allow concurrently.
+	// It is never contended with a single reader.
+	mutex sync.Mutex
+
+	// packets and bytes are nil when their limit is off.
+	packets *tokenBucket
+	bytes   *tokenBucket
+	// maxPPS and maxBPS are the limits, for the log.
+	maxPPS, maxBPS float64
+	// shed counts the packets dropped since the last log line, lastLog is when that was.
+	shed    int
+	lastLog time.Time
+}
+
+// udpActivity tracks when an address last received a packet, so its readers
+// can log when the simulation behind it goes silent and when it is back.
+// Every address has its own, shared by its readers: with -udp-readers the
+// kernel keeps a sender on one socket, the other readers of the address never
+// get a packet and mustn't take that for silence.
+type udpActivity struct {
+	addr string
+	// last is when the latest packet arrived, in Unix nanoseconds.
+	last atomic.Int64
+	// silent is set while the address is reported as silent.
+	silent atomic.Bool
+}
+
+// activityResolution is how precisely udpActivity.last is kept. Writing it
+// for every packet would make the readers of an address contend for it.
+const activityResolution = 100 * time.Millisecond
+
+// newUDPActivity starts out as if a packet had just arrived, so an address
+// the simulation never sends to is reported once ReadTimeout has passed.
+func newUDPActivity(addr string) *udpActivity {
+	a := &udpActivity{addr: addr}
+	a.last.Store(time.Now().UnixNano())
+	return a
+}
+
+// saw records a packet that arrived at `now`.
+func (a *udpActivity) saw(now time.Time) {
+	if ns := now.UnixNano(); ns-a.last.Load() >= int64(activityResolution) {
+		a.last.Store(ns)
+	}
+	// SYNTAX: CompareAndSwap only succeeds for one of the readers, so "resumed" is logged once.
+	if a.silent.Load() && a.silent.CompareAndSwap(true, false) {
+		slog.Info("UDP data resumed", "addr", a.addr)
+	}
+}
+
+// idle is called by a reader whose read timed out at `now`. It logs a
+// warning once the address hasn't received anything for `timeout`.
+func (a *udpActivity) idle(now time.Time, timeout time.Duration) {
+	quiet := now.Sub(time.Unix(0, a.last.Load()))
+	if quiet >= timeout && a.silent.CompareAndSwap(false, true) {
+		slog.Warn("no UDP data, is the simulation running?", "addr", a.addr, "for", quiet.Round(time.Second).String())
+	}
+}
+
+// shedLogInterval is how often a lasting flood is logged.
+const shedLogInterval = 10 * time.Second
+
+func newIngressLimiter(opts UDPOptions) *ingressLimiter {
+	l := &ingressLimiter{maxPPS: opts.MaxPPS, maxBPS: opts.MaxBPS}
+	// Both buckets allow a burst of one second's worth of traffic. The packet
+	// bucket holds at least one packet (-udp-max-pps may be below 1), the byte
+	// bucket at least one full read buffer, or nothing could ever pass.
+	if opts.MaxPPS > 0 {
+		l.packets = newTokenBucket(opts.MaxPPS, max(opts.MaxPPS, 1))
+	}
+	if opts.MaxBPS > 0 {
+		l.bytes = newTokenBucket(opts.MaxBPS, max(opts.MaxBPS, float64(opts.BufferSize)))
+	}
+	return l
+}
+
+// allow reports whether a packet of n bytes may pass. Shed packets are counted.
+func (l *ingressLimiter) allow(n int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if (l.packets == nil || l.packets.allow()) && (l.bytes == nil || l.bytes.allowN(float64(n))) {
+		return true
+	}
+	udpPacketsShed.Inc()
+	// During a flood almost every packet ends up here, one line every few seconds is plenty.
+	l.shed++
+	if time.Since(l.lastLog) >= shedLogInterval {
+		slog.Warn("UDP ingress over the rate limit, shedding packets", "shed", l.shed, "max_pps", l.maxPPS, "max_bps", l.maxBPS)
+		l.shed = 0
+		l.lastLog = time.Now()
+	}
+	return false
+}
+
+// errorFrameInterval is the least time between two error frames, so a storm of
+// bad packets doesn't become a storm of messages to every client.
+const errorFrameInterval = time.Second
+
+// errorReporter sends clients an error frame (see protocol.go) about dropped
+// packets, at most once per errorFrameInterval. Packets dropped in between are
+// counted in the next frame. It is safe for concurrent use, all listeners share one.
+type errorReporter struct {
+	hub  *Hub
+	wrap bool
+
+	mutex sync.Mutex
+	last  time.Time
+	count int
+}
+
+// newErrorReporter returns a reporter sending to `hub`'s clients, in envelopes if `wrap` is set.
+func newErrorReporter(hub *Hub, wrap bool) *errorReporter {
+	return &errorReporter{hub: hub, wrap: wrap}
+}
+
+// report records one dropped packet and the reason it was dropped.
+func (r *errorReporter) report(err error) {
+	r.mutex.Lock()
+	r.count++
+	if time.Since(r.last) < errorFrameInterval {
+		r.mutex.Unlock()
+		return
+	}
+	count := r.count
+	r.count = 0
+	r.last = time.Now()
+	r.mutex.Unlock()
+
+	// Outside our lock, SendAll takes the hub's.
+	r.hub.SendAll(errorMessage("malformed UDP packet: "+err.Error(), count, r.wrap))
+}
+
+// packetSource is where a live packet came from, used for TagSource and rooms.
+type packetSource struct {
+	// shard is the port the packet was received on.
+	shard int
+	// addr is the sender. Over a Unix socket it is nil unless the sender bound its own socket file.
+	addr net.Addr
+	// room is the listener's room, for packets that don't name one.
+	room string
+	// cacheOnly marks a packet UDPOptions.Sample left out, see Message.CacheOnly.
+	cacheOnly bool
+}
+
+// processPacket validates one packet and hands it to the hub.
+// It is shared by the live UDP loop and replay (see replay.go), which passes
+// a nil `source` because recordings don't keep the senders.
+func processPacket(packet []byte, source *packetSource, hub *Hub, opts UDPOptions, seq *seqTracker) {
+	received := time.Now()
+	sawData(received)
+	state, err := opts.Codec.Decode(packet)
+	if err != nil {
+		udpPacketsMalformed.Inc()
+		slog.Debug("malformed UDP packet", "err", err, "size", len(packet), "strict", opts.Strict)
+		if opts.Strict {
+			if opts.Errors != nil {
+				opts.Errors.report(err)
+			}
+			return
+		}
+	} else if state.Seq != nil {
+		if missing := seq.observe(*state.Seq); missing > 0 {
+			udpPacketsMissing.Add(float64(missing))
+			slog.Warn("UDP packets lost", "missing", missing, "seq", *state.Seq)
+		}
+	}
+	if err == nil && opts.Sanitize != nil {
+		changed, keep := opts.Sanitize.apply(&state)
+		if !keep {
+			return
+		}
+		// The packet has to say what the state now says. TranscodeJSON below
+		// encodes the state anyway, JSON packets keep their extra fields.
+		if changed && !opts.TranscodeJSON {
+			patched, ok := patchCoordinates(packet, state)
+			if !ok {
+				patched, _ = opts.Codec.Encode(state)
+			}
+			packet = patched
+		}
+	}
+	// Replayed states carry the timestamps of the recording, their transit time means nothing.
+	if err == nil && state.Timestamp > 0 && source != nil {
+		observeTransit(received, state.Timestamp)
+	}
+
+	// Browsers can't read most wire formats, so the states can be forwarded as JSON instead.
+	// Packets that failed to decode have nothing to re-encode and go out as they came in.
+	if opts.TranscodeJSON && err == nil {
+		if data, err := (jsonCodec{}).Encode(state); err == nil {
+			packet = data
+		}
+	}
+	// Tagging comes after transcoding, only JSON objects can carry the extra fields.
+	if opts.TagSource && source != nil {
+		packet = injectField(packet, "shard", source.shard)
+		if source.addr != nil {
+			packet = injectField(packet, "source", source.addr.String())
+		}
+	}
+
+	// Wrap the packet for the hub. It will be picked up by `Hub.Run` and forwarded to every client.
+	msg := Message{Type: websocket.TextMessage, Data: packet, RobotID: state.ID, Received: received}
+	if source != nil {
+		msg.Room = source.room
+		msg.CacheOnly = source.cacheOnly
+	}
+	if err == nil {
+		msg.State = &state
+		// A room named by the packet itself wins over the listener's.
+		if state.Room != "" && validRoomName(state.Room) {
+			msg.Room = state.Room
+		}
+	}
+	if opts.Binary || !utf8.Valid(msg.Data) {
+		msg.Type = websocket.BinaryMessage
+	}
+	hub.Broadcast(msg)
+}
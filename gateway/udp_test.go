@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUDP runs startUDPServer on a free loopback port. The hub isn't run,
+// the test takes the messages out of its broadcast queue itself (see nextBroadcast).
+func startUDP(t *testing.T, opts UDPOptions) (*net.UDPConn, *Hub) {
+	t.Helper()
+	if opts.Codec == nil {
+		opts.Codec = jsonCodec{}
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = maxUDPPayload
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(HubOptions{QueueSize: 1024})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		startUDPServer(ctx, conn, hub, opts, newIngressLimiter(opts), newUDPActivity(conn.LocalAddr().String()))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return conn, hub
+}
+
+// dialUDP returns a socket sending to `to`.
+func dialUDP(t *testing.T, to *net.UDPConn) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, to.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nextBroadcast returns the next message the UDP server queued for the hub.
+func nextBroadcast(t *testing.T, hub *Hub) Message {
+	t.Helper()
+	select {
+	case msg := <-hub.broadcast:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message broadcast")
+		return Message{}
+	}
+}
+
+func TestUDPLargePacketIsNotTruncated(t *testing.T) {
+	server, hub := startUDP(t, UDPOptions{})
+	packet := bytes.Repeat([]byte("0123456789"), 2000) // 20 KB
+	if _, err := dialUDP(t, server).Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextBroadcast(t, hub).Data; !bytes.Equal(got, packet) {
+		t.Fatalf("got %d bytes, want the %d bytes sent", len(got), len(packet))
+	}
+}
+
+// The messages wait in the queue while the reader already reads the next
+// packets, with a read buffer shared with the messages every one of them
+// would end up holding the last packet. Run with -race.
+func TestUDPPayloadsSurviveASlowConsumer(t *testing.T) {
+	server, hub := startUDP(t, UDPOptions{})
+	sender := dialUDP(t, server)
+
+	const packets = 500
+	// Every packet is one byte value repeated, so a packet overwritten by another shows.
+	payload := func(i int) []byte {
+		return bytes.Repeat([]byte{'a' + byte(i%26)}, 100+i)
+	}
+	for i := range packets {
+		if _, err := sender.Write(payload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only now consume, as slow as it gets. The kernel may drop packets
+	// under load, so waiting for all of them may time out, but every message
+	// that arrived must be intact.
+	for deadline := time.Now().Add(2 * time.Second); len(hub.broadcast) < packets && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := 0
+	for len(hub.broadcast) > 0 {
+		msg := <-hub.broadcast
+		i := len(msg.Data) - 100
+		if i < 0 || i >= packets || !bytes.Equal(msg.Data, payload(i)) {
+			t.Fatalf("message %d is corrupted: %q...", received, msg.Data[:min(len(msg.Data), 20)])
+		}
+		received++
+	}
+	if received == 0 {
+		t.Fatal("no packet arrived")
+	}
+}
+
+func TestUDPTagSource(t *testing.T) {
+	server, hub := startUDP(t, UDPOptions{TagSource: true})
+	shard := server.LocalAddr().(*net.UDPAddr).Port
+	senders := []*net.UDPConn{dialUDP(t, server), dialUDP(t, server)}
+
+	for i, sender := range senders {
+		if _, err := sender.Write([]byte(`{"id":"robot_` + strconv.Itoa(i) + `","x":1,"y":2}`)); err != nil {
+			t.Fatal(err)
+		}
+		var tagged struct {
+			ID     string `json:"id"`
+			Shard  int    `json:"shard"`
+			Source string `json:"source"`
+		}
+		data := nextBroadcast(t, hub).Data
+		if err := json.Unmarshal(data, &tagged); err != nil {
+			t.Fatalf("tagged packet %s: %v", data, err)
+		}
+		if want := "robot_" + strconv.Itoa(i); tagged.ID != want {
+			t.Errorf("id = %q, want %q", tagged.ID, want)
+		}
+		if tagged.Shard != shard {
+			t.Errorf("%s: shard = %d, want the receiving port %d", tagged.ID, tagged.Shard, shard)
+		}
+		if want := sender.LocalAddr().String(); tagged.Source != want {
+			t.Errorf("%s: source = %q, want the sender %q", tagged.ID, tagged.Source, want)
+		}
+	}
+}
+
+func TestParseIngestAddr(t *testing.T) {
+	tests := []struct {
+		network, addr string
+		wantIP        net.IP // nil for the wildcard address
+		wantPort      int
+		wantRoom      string
+		wantErr       bool
+	}{
+		{network: "udp", addr: ":8000", wantPort: 8000},
+		{network: "udp", addr: "0.0.0.0:8000", wantIP: net.IPv4zero, wantPort: 8000},
+		{network: "udp", addr: "[::]:8000", wantIP: net.IPv6unspecified, wantPort: 8000},
+		{network: "udp4", addr: "127.0.0.1:8000", wantIP: net.IPv4(127, 0, 0, 1), wantPort: 8000},
+		{network: "udp6", addr: "[::1]:8000", wantIP: net.IPv6loopback, wantPort: 8000},
+		{network: "udp6", addr: "[fe80::1%lo]:8000", wantIP: net.ParseIP("fe80::1"), wantPort: 8000},
+		{network: "udp", addr: "swarm-a=[::1]:8002", wantIP: net.IPv6loopback, wantPort: 8002, wantRoom: "swarm-a"},
+		{network: "udp4", addr: "swarm-b=127.0.0.1:8003", wantIP: net.IPv4(127, 0, 0, 1), wantPort: 8003, wantRoom: "swarm-b"},
+		{network: "udp4", addr: "[::1]:8000", wantErr: true},
+		{network: "udp6", addr: "127.0.0.1:8000", wantErr: true},
+		{network: "udp", addr: "::1:8000", wantErr: true}, // IPv6 needs brackets
+		{network: "udp", addr: strings.Repeat("r", maxRoomNameLen+1) + "=:8000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+" "+tt.addr, func(t *testing.T) {
+			got, err := parseIngestAddr(tt.network, tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got.udp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.udp.IP.Equal(tt.wantIP) || got.udp.Port != tt.wantPort || got.room != tt.wantRoom {
+				t.Errorf("got IP %v port %d room %q, want IP %v port %d room %q",
+					got.udp.IP, got.udp.Port, got.room, tt.wantIP, tt.wantPort, tt.wantRoom)
+			}
+		})
+	}
+}
+
+func TestValidUDPNetwork(t *testing.T) {
+	for network, want := range map[string]bool{
+		"udp": true, "udp4": true, "udp6": true,
+		"": false, "UDP": false, "tcp": false, "ip6": false, "unixgram": false,
+	} {
+		if got := validUDPNetwork(network); got != want {
+			t.Errorf("validUDPNetwork(%q) = %v, want %v", network, got, want)
+		}
+	}
+}
+
+// ":0" with the "udp" network binds both stacks: packets to 127.0.0.1 and
+// to [::1] arrive on the same socket.
+func TestUDPDualStack(t *testing.T) {
+	addr, err := parseIngestAddr("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", addr.udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		sender, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			t.Skipf("no %v on this host: %v", ip, err)
+		}
+		defer sender.Close()
+		if _, err := sender.Write([]byte(ip.String())); err != nil {
+			t.Skipf("can't send to %v: %v", ip, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("packet to %v: %v", ip, err)
+		}
+		if got := string(buf[:n]); got != ip.String() {
+			t.Errorf("got %q, want %q", got, ip.String())
+		}
+	}
+}
+
+// -udp-max-pps below 1 lets a packet through every 1/rate seconds instead of
+// silencing the ingest.
+func TestIngressLimiterFractionalRate(t *testing.T) {
+	limiter := newIngressLimiter(UDPOptions{MaxPPS: 0.5, BufferSize: maxUDPPayload})
+	if !limiter.allow(100) {
+		t.Fatal("first packet shed")
+	}
+	if limiter.allow(100) {
+		t.Error("second packet right away let through")
+	}
+	// As if 4 seconds had passed, the bucket still holds only one packet.
+	limiter.packets.last = limiter.packets.last.Add(-4 * time.Second)
+	if !limiter.allow(100) {
+		t.Error("packet after 1/rate seconds shed")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json" // For the response body
+	"net/http"      // For the handler
+	"runtime"       // For the Go version
+	"runtime/debug" // For the VCS info the go command embeds
+	"sync"          // For computing the build info once
+)
+
+// --- Build Info ---
+// After a deploy, "/version" on the admin server confirms which build is running:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// Without the flags the commit and time come from the VCS info the go command
+// embeds in binaries built inside a git checkout (`go run` doesn't embed it).
+
+// Set with -ldflags -X, see above. They must stay plain string variables for -X to work.
+var (
+	commit    string
+	buildTime string
+)
+
+// buildInfo is the JSON body of "/version", and the "build" field of "/stats".
+type buildInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	// Modified is set when the commit had uncommitted changes on top (VCS info only).
+	Modified bool `json:"modified,omitempty"`
+}
+
+// currentBuild returns the build info, it doesn't change while the process runs.
+// SYNTAX: sync.OnceValue wraps the function so it runs on the first call only,
+// later calls return the same result.
+var currentBuild = sync.OnceValue(func() buildInfo {
+	info := buildInfo{Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	// The VCS info only describes the build if -X didn't name another commit.
+	if bi, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				// The commit's time, the closest thing to a build time there is.
+				info.BuildTime = s.Value
+			case s.Key == "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+})
+
+// handleVersion answers "/version".
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBuild())
+}